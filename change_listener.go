@@ -0,0 +1,76 @@
+package loggingdrain
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// changeListener is notified of every log message added to a miner, with
+// the cluster it was added to.
+type changeListener func(ClusterUpdateType, *LogCluster)
+
+// changeListeners is a copy on write list, so that notifying the listeners
+// of a log message does not take a lock.
+type changeListeners struct {
+	mu      sync.Mutex
+	entries atomic.Pointer[[]*changeListenerEntry]
+}
+
+type changeListenerEntry struct {
+	listener changeListener
+}
+
+// add registers listener and returns the function unregistering it.
+func (l *changeListeners) add(listener changeListener) func() {
+	entry := l.register(listener)
+	return func() {
+		l.remove(entry)
+	}
+}
+
+// register registers listener and returns its entry, for notifyExcept.
+func (l *changeListeners) register(listener changeListener) *changeListenerEntry {
+	entry := &changeListenerEntry{listener: listener}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []*changeListenerEntry{}
+	if current := l.entries.Load(); current != nil {
+		entries = append(entries, *current...)
+	}
+	entries = append(entries, entry)
+	l.entries.Store(&entries)
+	return entry
+}
+
+func (l *changeListeners) remove(entry *changeListenerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := l.entries.Load()
+	if current == nil {
+		return
+	}
+	entries := []*changeListenerEntry{}
+	for _, e := range *current {
+		if e != entry {
+			entries = append(entries, e)
+		}
+	}
+	l.entries.Store(&entries)
+}
+
+func (l *changeListeners) notify(updateType ClusterUpdateType, cluster *LogCluster) {
+	l.notifyExcept(nil, updateType, cluster)
+}
+
+// notifyExcept notifies every listener but the one of except.
+func (l *changeListeners) notifyExcept(except *changeListenerEntry, updateType ClusterUpdateType, cluster *LogCluster) {
+	entries := l.entries.Load()
+	if entries == nil {
+		return
+	}
+	for _, e := range *entries {
+		if e != except {
+			e.listener(updateType, cluster)
+		}
+	}
+}
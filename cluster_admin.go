@@ -0,0 +1,193 @@
+package loggingdrain
+
+import (
+	"fmt"
+)
+
+// DeleteCluster removes the cluster with id from the miner, the log messages
+// it matched create a new cluster afterwards. A ClusterNotFoundError is
+// returned when the miner does not know id.
+func (miner *TemplateMiner) DeleteCluster(id int64) error {
+	cluster, err := miner.drain.deleteCluster(id)
+	if err != nil {
+		return err
+	}
+	miner.listeners.notify(CLUSTER_UPDATE_TYPE_DELETE_CLUSTER, cluster)
+	return nil
+}
+
+// MergeClusters merges the clusters with id1 and id2, which must have the
+// same token count, and returns the merged cluster.
+//
+// The locked cluster, or else the cluster with the more general template and
+// id1 among equals, is kept: its template gets a wildcard wherever the
+// templates differ and it adds up the statistics, the name and the pin of the
+// other cluster, which is removed. A ClusterNotFoundError is returned when
+// the miner does not know an id, a TemplateMismatchError when the token
+// counts differ or the locked template would have to be generalized.
+func (miner *TemplateMiner) MergeClusters(id1, id2 int64) (*LogCluster, error) {
+	cluster, err := miner.drain.mergeClusters(id1, id2)
+	if err != nil {
+		return nil, err
+	}
+	miner.listeners.notify(CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, cluster)
+	return cluster, nil
+}
+
+// PinCluster pins the cluster with id so that it is never evicted.
+func (miner *TemplateMiner) PinCluster(id int64) error {
+	return miner.updateCluster(id, func(cluster *LogCluster) {
+		cluster.pinned = true
+	})
+}
+
+// UnpinCluster unpins the cluster with id, it is evicted by the next new
+// cluster when the miner holds more than the max cluster count.
+func (miner *TemplateMiner) UnpinCluster(id int64) error {
+	return miner.updateCluster(id, func(cluster *LogCluster) {
+		cluster.pinned = false
+	})
+}
+
+// SetClusterName attaches a human readable name to the cluster with id, an
+// empty name removes it. The name is persisted with the cluster.
+func (miner *TemplateMiner) SetClusterName(id int64, name string) error {
+	return miner.updateCluster(id, func(cluster *LogCluster) {
+		cluster.name = name
+	})
+}
+
+func (miner *TemplateMiner) updateCluster(id int64, update func(*LogCluster)) error {
+	cluster, err := miner.drain.updateCluster(id, update)
+	if err != nil {
+		return err
+	}
+	miner.listeners.notify(CLUSTER_UPDATE_TYPE_UPDATE_METADATA, cluster)
+	return nil
+}
+
+// lookupCluster returns the cluster with id, the drain lock must be held.
+func (drain *drain) lookupCluster(id int64) (*LogCluster, error) {
+	cluster, ok := drain.idToCluster.Peek(id)
+	if !ok || cluster == nil {
+		return nil, errClusterNotFoundRaw(fmt.Sprintf("cluster %d not found", id))
+	}
+	return cluster, nil
+}
+
+func (drain *drain) deleteCluster(id int64) (*LogCluster, error) {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	cluster, err := drain.lookupCluster(id)
+	if err != nil {
+		return nil, err
+	}
+	drain.idToCluster.Remove(id)
+	drain.pruneCluster(cluster)
+	return cluster, nil
+}
+
+func (drain *drain) updateCluster(id int64, update func(*LogCluster)) (*LogCluster, error) {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	cluster, err := drain.lookupCluster(id)
+	if err != nil {
+		return nil, err
+	}
+	cluster.mu.Lock()
+	update(cluster)
+	cluster.mu.Unlock()
+	return cluster, nil
+}
+
+func (drain *drain) mergeClusters(id1, id2 int64) (*LogCluster, error) {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	kept, err := drain.lookupCluster(id1)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := drain.lookupCluster(id2)
+	if err != nil {
+		return nil, err
+	}
+	if kept == merged {
+		return kept, nil
+	}
+	if len(kept.logTemplateTokens) != len(merged.logTemplateTokens) {
+		return nil, errTemplateMismatchRaw(fmt.Sprintf(
+			"cluster %d has %d tokens, cluster %d has %d tokens",
+			id1, len(kept.logTemplateTokens), id2, len(merged.logTemplateTokens)))
+	}
+	if kept.locked && merged.locked {
+		return nil, errTemplateMismatchRaw(fmt.Sprintf("clusters %d and %d are both locked", id1, id2))
+	}
+	if merged.locked || (!kept.locked &&
+		wildcardCount(merged.logTemplateTokens) > wildcardCount(kept.logTemplateTokens)) {
+		kept, merged = merged, kept
+	}
+	if kept.locked && !templateFits(kept.logTemplateTokens, merged.logTemplateTokens) {
+		return nil, errTemplateMismatchRaw(fmt.Sprintf(
+			"the template of cluster %d does not fit the locked cluster %d", merged.id, kept.id))
+	}
+
+	merged.mu.RLock()
+	tokens := merged.logTemplateTokens
+	size, firstSeen, lastSeen := merged.size, merged.firstSeen, merged.lastSeen
+	name, pinned := merged.name, merged.pinned
+	lineage := append(append([]string{}, merged.lineage...), fingerprint(tokens))
+	merged.mu.RUnlock()
+
+	kept.mu.Lock()
+	kept.lineage = append(kept.lineage, lineage...)
+	if _, err := drain.generalizeTemplate(kept, tokens, drain.now()); err != nil {
+		kept.mu.Unlock()
+		return nil, err
+	}
+	kept.size += size
+	if kept.firstSeen.IsZero() || (!firstSeen.IsZero() && firstSeen.Before(kept.firstSeen)) {
+		kept.firstSeen = firstSeen
+	}
+	if lastSeen.After(kept.lastSeen) {
+		kept.lastSeen = lastSeen
+	}
+	if kept.name == "" {
+		kept.name = name
+	}
+	kept.pinned = kept.pinned || pinned
+	kept.mu.Unlock()
+
+	// the kept cluster is inserted again with its generalized template, so
+	// that it has a single leaf like any other cluster, the emptied branches
+	// go away first or they would still route the log messages of both
+	// clusters away from it
+	drain.idToCluster.Remove(merged.id)
+	drain.pruneCluster(merged)
+	drain.pruneCluster(kept)
+	dropEmptyNodes(drain.rootNode.lengthNodeChildren[len(kept.logTemplateTokens)])
+	drain.addSeqToPrefixTree(drain.rootNode, kept)
+	drain.idToCluster.Get(kept.id)
+	drain.idToCluster.Update(kept.id)
+	return kept, nil
+}
+
+// dropEmptyNodes removes the token nodes below node that lead to no cluster
+// and reports whether node itself leads to none.
+func dropEmptyNodes(node *treeNode) bool {
+	for token, child := range node.tokenNodeChildren {
+		if dropEmptyNodes(child) {
+			delete(node.tokenNodeChildren, token)
+		}
+	}
+	return len(node.clusters) == 0 && len(node.tokenNodeChildren) == 0
+}
+
+func wildcardCount(tokens []string) int {
+	count := 0
+	for _, token := range tokens {
+		if token == default_wildcard_str {
+			count += 1
+		}
+	}
+	return count
+}
@@ -0,0 +1,163 @@
+package loggingdrain
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterAdmin(t *testing.T) {
+	t.Run("test delete cluster", func(t *testing.T) {
+		miner := newTestMiner(t, len(testData))
+		cluster := miner.Match(testData[0])
+		if err := miner.DeleteCluster(cluster.ID()); err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, miner.GetCluster(cluster.ID()))
+		assert.Nil(t, miner.Match(testData[0]))
+		assert.Nil(t, miner.CheckConsistency())
+
+		response := miner.AddLogMessage(testData[0])
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, response.ChangeType)
+		assert.NotEqual(t, cluster.ID(), response.Cluster.ID())
+
+		err := miner.DeleteCluster(cluster.ID())
+		assert.True(t, errorIs(err, clusterNotFoundError))
+	})
+	t.Run("test merge clusters", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		first := miner.AddLogMessage("user alice logged in").Cluster
+		miner.AddLogMessage("user alice logged in")
+		second := miner.AddLogMessage("admin alice logged in").Cluster
+		miner.AddLogMessage("admin bob logged in")
+		assert.NotEqual(t, first.ID(), second.ID())
+		if err := miner.SetClusterName(first.ID(), "login"); err != nil {
+			t.Fatal(err)
+		}
+
+		merged, err := miner.MergeClusters(first.ID(), second.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Same(t, second, merged)
+		assert.Equal(t, "[*] [*] logged in", merged.Template())
+		assert.Equal(t, int64(4), merged.Size())
+		assert.Equal(t, "login", merged.Name())
+		assert.Nil(t, miner.GetCluster(first.ID()))
+		assert.Nil(t, miner.CheckConsistency())
+
+		// both former templates reach the merged cluster
+		for _, log := range []string{"user dave logged in", "admin erin logged in"} {
+			response := miner.AddLogMessage(log)
+			assert.Same(t, merged, response.Cluster)
+		}
+		assert.Nil(t, miner.CheckConsistency())
+	})
+	t.Run("test merged cluster is reloaded", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		first := miner.AddLogMessage("user alice logged in").Cluster
+		second := miner.AddLogMessage("admin alice logged in").Cluster
+		miner.AddLogMessage("admin bob logged in")
+		merged, err := miner.MergeClusters(first.ID(), second.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, merged.leaves, 1)
+		check := func(loaded *TemplateMiner) {
+			assert.Nil(t, loaded.CheckConsistency())
+			cluster := loaded.Match("user carol logged in")
+			if assert.NotNil(t, cluster) {
+				assert.Equal(t, merged.ID(), cluster.ID())
+			}
+		}
+		check(miner)
+
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		check(&loaded)
+
+		data, _ := miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		check(&loaded)
+	})
+	t.Run("test merge errors", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		first := miner.AddLogMessage("user alice logged in").Cluster
+		second := miner.AddLogMessage("disk is full").Cluster
+		_, err := miner.MergeClusters(first.ID(), second.ID())
+		assert.True(t, errorIs(err, templateMismatchError))
+		_, err = miner.MergeClusters(first.ID(), 42)
+		assert.True(t, errorIs(err, clusterNotFoundError))
+	})
+	t.Run("test pin cluster", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithDrainMaxCluster(1))
+		pinned := miner.AddLogMessage("user alice logged in").Cluster
+		if err := miner.PinCluster(pinned.ID()); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, pinned.Pinned())
+		miner.AddLogMessage("disk is full")
+		latest := miner.AddLogMessage("connection reset by peer").Cluster
+		assert.Equal(t, []*LogCluster{pinned, latest}, miner.Clusters(CLUSTER_SORT_BY_ID))
+
+		if err := miner.UnpinCluster(pinned.ID()); err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("cpu is hot")
+		assert.Nil(t, miner.GetCluster(pinned.ID()))
+		assert.True(t, errorIs(miner.PinCluster(pinned.ID()), clusterNotFoundError))
+	})
+	t.Run("test name and pin are persisted", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		if err := miner.SetClusterName(1, "auth"); err != nil {
+			t.Fatal(err)
+		}
+		if err := miner.PinCluster(2); err != nil {
+			t.Fatal(err)
+		}
+		check := func(loaded *TemplateMiner) {
+			assert.Equal(t, "auth", loaded.GetCluster(1).Name())
+			assert.False(t, loaded.GetCluster(1).Pinned())
+			assert.True(t, loaded.GetCluster(2).Pinned())
+		}
+
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		check(&loaded)
+
+		data, _ := miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		check(&loaded)
+
+		p := newRedisIncrementalPersistence(newFakeRedisClient(), "test")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		if err := miner.SetClusterName(2, "user"); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(restored)
+		assert.Equal(t, "user", restored.GetCluster(2).Name())
+	})
+}
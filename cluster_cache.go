@@ -0,0 +1,231 @@
+package loggingdrain
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+type EvictionPolicy int
+
+const (
+	// EVICTION_POLICY_LRU evicts the least recently used cluster, a cluster
+	// is used when it is created or its template is updated.
+	EVICTION_POLICY_LRU EvictionPolicy = iota
+	// EVICTION_POLICY_LFU evicts the cluster matched by the fewest log
+	// messages, the least recently seen one first among equals.
+	EVICTION_POLICY_LFU
+)
+
+// clusterCache maps the ids to the clusters, it holds at most capacity
+// clusters besides the pinned ones, which are never evicted.
+//
+// It is not safe for concurrent use, the drain lock guards it: reads under
+// the read lock, writes under the write lock.
+type clusterCache struct {
+	policy   EvictionPolicy
+	capacity int
+
+	entries map[int64]*cacheEntry
+	// recency orders the entries from the most to the least recently used.
+	recency *list.List
+	// frequency orders the entries by size for EVICTION_POLICY_LFU.
+	frequency cacheHeap
+}
+
+type cacheEntry struct {
+	id      int64
+	cluster *LogCluster
+	element *list.Element
+	// index in the frequency heap.
+	index int
+}
+
+func newClusterCache(capacity int, policy EvictionPolicy) *clusterCache {
+	return &clusterCache{
+		policy:   policy,
+		capacity: capacity,
+		entries:  map[int64]*cacheEntry{},
+		recency:  list.New(),
+	}
+}
+
+// Add adds or replaces the cluster of id as the most recently used one, the
+// clusters evicted to keep the cache within its capacity are returned.
+func (c *clusterCache) Add(id int64, cluster *LogCluster) []*LogCluster {
+	if entry, ok := c.entries[id]; ok {
+		entry.cluster = cluster
+		c.use(entry)
+		return nil
+	}
+	entry := &cacheEntry{id: id, cluster: cluster}
+	entry.element = c.recency.PushFront(entry)
+	c.entries[id] = entry
+	if c.policy == EVICTION_POLICY_LFU {
+		heap.Push(&c.frequency, entry)
+	}
+	return c.evict(entry)
+}
+
+// Get returns the cluster of id and marks it as the most recently used one.
+func (c *clusterCache) Get(id int64) (*LogCluster, bool) {
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	c.use(entry)
+	return entry.cluster, true
+}
+
+// Peek returns the cluster of id without using it.
+func (c *clusterCache) Peek(id int64) (*LogCluster, bool) {
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.cluster, true
+}
+
+func (c *clusterCache) Contains(id int64) bool {
+	_, ok := c.entries[id]
+	return ok
+}
+
+// Update reorders the cluster of id after its statistics changed.
+func (c *clusterCache) Update(id int64) {
+	entry, ok := c.entries[id]
+	if ok && c.policy == EVICTION_POLICY_LFU {
+		heap.Fix(&c.frequency, entry.index)
+	}
+}
+
+// Remove removes the cluster of id, the eviction callback is not called.
+func (c *clusterCache) Remove(id int64) bool {
+	entry, ok := c.entries[id]
+	if !ok {
+		return false
+	}
+	c.remove(entry)
+	return true
+}
+
+// Keys returns the ids from the least to the most recently used.
+func (c *clusterCache) Keys() []int64 {
+	keys := make([]int64, 0, len(c.entries))
+	for e := c.recency.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(*cacheEntry).id)
+	}
+	return keys
+}
+
+// Values returns the clusters from the least to the most recently used.
+func (c *clusterCache) Values() []*LogCluster {
+	values := make([]*LogCluster, 0, len(c.entries))
+	for e := c.recency.Back(); e != nil; e = e.Prev() {
+		values = append(values, e.Value.(*cacheEntry).cluster)
+	}
+	return values
+}
+
+func (c *clusterCache) Len() int {
+	return len(c.entries)
+}
+
+func (c *clusterCache) use(entry *cacheEntry) {
+	c.recency.MoveToFront(entry.element)
+	if c.policy == EVICTION_POLICY_LFU {
+		heap.Fix(&c.frequency, entry.index)
+	}
+}
+
+func (c *clusterCache) remove(entry *cacheEntry) {
+	delete(c.entries, entry.id)
+	c.recency.Remove(entry.element)
+	if c.policy == EVICTION_POLICY_LFU {
+		heap.Remove(&c.frequency, entry.index)
+	}
+}
+
+// evict evicts clusters until the cache fits its capacity, skipping the
+// pinned clusters and the added entry.
+func (c *clusterCache) evict(added *cacheEntry) []*LogCluster {
+	var evicted []*LogCluster
+	for len(c.entries) > c.capacity {
+		victim := c.victim(added)
+		if victim == nil {
+			break
+		}
+		c.remove(victim)
+		evicted = append(evicted, victim.cluster)
+	}
+	return evicted
+}
+
+func (c *clusterCache) victim(added *cacheEntry) *cacheEntry {
+	if c.policy == EVICTION_POLICY_LFU {
+		// pop the skipped entries and push them back afterwards
+		skipped := []*cacheEntry{}
+		defer func() {
+			for _, entry := range skipped {
+				heap.Push(&c.frequency, entry)
+			}
+		}()
+		for c.frequency.Len() > 0 {
+			entry := c.frequency[0]
+			if entry != added && !isPinned(entry.cluster) {
+				return entry
+			}
+			skipped = append(skipped, heap.Pop(&c.frequency).(*cacheEntry))
+		}
+		return nil
+	}
+	for e := c.recency.Back(); e != nil; e = e.Prev() {
+		entry := e.Value.(*cacheEntry)
+		if entry != added && !isPinned(entry.cluster) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func isPinned(cluster *LogCluster) bool {
+	return cluster != nil && cluster.pinned
+}
+
+// cacheHeap is a min heap of the entries by size, then by last seen time
+// and id.
+type cacheHeap []*cacheEntry
+
+func (h cacheHeap) Len() int { return len(h) }
+
+func (h cacheHeap) Less(i, j int) bool {
+	a, b := h[i].cluster, h[j].cluster
+	if a.size != b.size {
+		return a.size < b.size
+	}
+	if !a.lastSeen.Equal(b.lastSeen) {
+		return a.lastSeen.Before(b.lastSeen)
+	}
+	return h[i].id < h[j].id
+}
+
+func (h cacheHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *cacheHeap) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *cacheHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
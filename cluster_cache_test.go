@@ -0,0 +1,131 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCachedCluster(id int64, size int64, lastSeen time.Time) *LogCluster {
+	cluster := newLogCluster(id, []string{"a"})
+	cluster.size = size
+	cluster.lastSeen = lastSeen
+	return cluster
+}
+
+func evictedIDs(clusters []*LogCluster) []int64 {
+	ids := []int64{}
+	for _, cluster := range clusters {
+		ids = append(ids, cluster.id)
+	}
+	return ids
+}
+
+func TestClusterCache(t *testing.T) {
+	now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	t.Run("test lru", func(t *testing.T) {
+		cache := newClusterCache(2, EVICTION_POLICY_LRU)
+		cache.Add(1, newCachedCluster(1, 10, now))
+		cache.Add(2, newCachedCluster(2, 1, now))
+		cache.Get(1)
+		assert.Equal(t, []int64{2}, evictedIDs(cache.Add(3, newCachedCluster(3, 1, now))))
+		assert.Equal(t, []int64{1, 3}, cache.Keys())
+	})
+	t.Run("test lfu", func(t *testing.T) {
+		cache := newClusterCache(2, EVICTION_POLICY_LFU)
+		one := newCachedCluster(1, 10, now)
+		two := newCachedCluster(2, 5, now)
+		cache.Add(1, one)
+		cache.Add(2, two)
+		assert.Equal(t, []int64{2}, evictedIDs(cache.Add(3, newCachedCluster(3, 1, now))))
+
+		// the added cluster is never evicted at once
+		assert.Equal(t, []int64{3}, evictedIDs(cache.Add(4, newCachedCluster(4, 1, now))))
+
+		// the least recently seen cluster goes first among equals
+		four, _ := cache.Peek(4)
+		four.size = 10
+		four.lastSeen = now.Add(time.Second)
+		cache.Update(4)
+		assert.Equal(t, []int64{1}, evictedIDs(cache.Add(5, newCachedCluster(5, 1, now))))
+		assert.Equal(t, []int64{4, 5}, cache.Keys())
+	})
+	t.Run("test pinned clusters are kept", func(t *testing.T) {
+		for _, policy := range []EvictionPolicy{EVICTION_POLICY_LRU, EVICTION_POLICY_LFU} {
+			cache := newClusterCache(1, policy)
+			pinned := newCachedCluster(1, 1, now)
+			pinned.pinned = true
+			cache.Add(1, pinned)
+			assert.Empty(t, cache.Add(2, newCachedCluster(2, 5, now)))
+			assert.Equal(t, []int64{2}, evictedIDs(cache.Add(3, newCachedCluster(3, 5, now))))
+			assert.Equal(t, []int64{1, 3}, cache.Keys())
+
+			cache.Remove(3)
+			assert.Equal(t, []int64{1}, cache.Keys())
+		}
+	})
+}
+
+func TestEviction(t *testing.T) {
+	t.Run("test eviction callback", func(t *testing.T) {
+		evicted := []*LogCluster{}
+		miner, _ := NewTemplateMiner(
+			WithDrainMaxCluster(1),
+			WithEvictionCallback(func(cluster *LogCluster) {
+				evicted = append(evicted, cluster)
+			}),
+		)
+		miner.AddLogMessage("user alice logged in")
+		miner.AddLogMessage("user bob logged in")
+		assert.Empty(t, evicted)
+
+		miner.AddLogMessage("disk is full")
+		assert.Len(t, evicted, 1)
+		assert.Equal(t, "user [*] logged in", evicted[0].Template())
+		assert.Equal(t, int64(2), evicted[0].Size())
+		assert.False(t, evicted[0].LastSeen().IsZero())
+	})
+	t.Run("test evicted clusters are pruned from the tree", func(t *testing.T) {
+		for _, policy := range []EvictionPolicy{EVICTION_POLICY_LRU, EVICTION_POLICY_LFU} {
+			miner, _ := NewTemplateMiner(WithDrainMaxCluster(5), WithEvictionPolicy(policy))
+			for _, log := range testData {
+				miner.AddLogMessage(log)
+			}
+			assert.Nil(t, miner.CheckConsistency())
+
+			treeClusters := 0
+			for length := 0; length < 100; length++ {
+				treeClusters += len(miner.drain.getClustersForSeqLen(length))
+			}
+			assert.Equal(t, 5, treeClusters)
+		}
+	})
+	t.Run("test lfu keeps the frequent clusters", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithDrainMaxCluster(2), WithEvictionPolicy(EVICTION_POLICY_LFU))
+		frequent := miner.AddLogMessage("user alice logged in").Cluster
+		miner.AddLogMessage("disk is full")
+		miner.AddLogMessage("user bob logged in")
+		latest := miner.AddLogMessage("connection reset by peer").Cluster
+		assert.Equal(t, []*LogCluster{frequent, latest}, miner.Clusters(CLUSTER_SORT_BY_ID))
+	})
+	t.Run("test policy is persisted", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithEvictionPolicy(EVICTION_POLICY_LFU))
+		miner.AddLogMessage("user alice logged in")
+
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, EVICTION_POLICY_LFU, loaded.drain.idToCluster.policy)
+
+		data, _ := miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, EVICTION_POLICY_LFU, loaded.drain.idToCluster.policy)
+	})
+}
@@ -0,0 +1,145 @@
+package loggingdrain
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ClusterSortOrder int
+
+const (
+	// CLUSTER_SORT_BY_ID sorts by ascending id.
+	CLUSTER_SORT_BY_ID ClusterSortOrder = iota
+	// CLUSTER_SORT_BY_SIZE sorts the largest clusters first.
+	CLUSTER_SORT_BY_SIZE
+	// CLUSTER_SORT_BY_LAST_SEEN sorts the most recently seen clusters first.
+	CLUSTER_SORT_BY_LAST_SEEN
+)
+
+// ClusterFilter selects clusters, the zero value selects every cluster.
+type ClusterFilter struct {
+	// TokenCount keeps the clusters with this many template tokens when
+	// positive.
+	TokenCount int
+	// Contains keeps the clusters whose template contains the substring.
+	Contains string
+	// Pattern keeps the clusters whose template matches the regexp when set.
+	Pattern *regexp.Regexp
+}
+
+// Clusters returns all clusters known by the miner.
+func (miner *TemplateMiner) Clusters(order ClusterSortOrder) []*LogCluster {
+	return sortClusters(miner.drain.clusters(), order)
+}
+
+// FindClusters returns the clusters selected by filter.
+func (miner *TemplateMiner) FindClusters(filter ClusterFilter, order ClusterSortOrder) []*LogCluster {
+	return sortClusters(filter.apply(miner.drain.clusters()), order)
+}
+
+// GetCluster returns the cluster with id, or nil when the miner does not
+// know it. The recency of the cluster is not updated.
+func (miner *TemplateMiner) GetCluster(id int64) *LogCluster {
+	return miner.drain.getCluster(id)
+}
+
+// Clusters returns all clusters of all shards.
+func (miner *ShardedTemplateMiner) Clusters(order ClusterSortOrder) []*LogCluster {
+	return sortClusters(miner.clusters(), order)
+}
+
+// FindClusters returns the clusters of all shards selected by filter.
+func (miner *ShardedTemplateMiner) FindClusters(filter ClusterFilter, order ClusterSortOrder) []*LogCluster {
+	return sortClusters(filter.apply(miner.clusters()), order)
+}
+
+// GetCluster returns the cluster with id, or nil when no shard knows it.
+func (miner *ShardedTemplateMiner) GetCluster(id int64) *LogCluster {
+	if id < 1 {
+		return nil
+	}
+	return miner.shards[(id-1)%int64(len(miner.shards))].getCluster(id)
+}
+
+func (miner *ShardedTemplateMiner) clusters() []*LogCluster {
+	clusters := []*LogCluster{}
+	for _, shard := range miner.shards {
+		clusters = append(clusters, shard.clusters()...)
+	}
+	return clusters
+}
+
+func (drain *drain) clusters() []*LogCluster {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	return drain.idToCluster.Values()
+}
+
+func (drain *drain) getCluster(id int64) *LogCluster {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	cluster, ok := drain.idToCluster.Peek(id)
+	if !ok {
+		return nil
+	}
+	return cluster
+}
+
+func (filter ClusterFilter) apply(clusters []*LogCluster) []*LogCluster {
+	selected := []*LogCluster{}
+	for _, cluster := range clusters {
+		tokens := cluster.Tokens()
+		if filter.TokenCount > 0 && len(tokens) != filter.TokenCount {
+			continue
+		}
+		template := strings.Join(tokens, " ")
+		if filter.Contains != "" && !strings.Contains(template, filter.Contains) {
+			continue
+		}
+		if filter.Pattern != nil && !filter.Pattern.MatchString(template) {
+			continue
+		}
+		selected = append(selected, cluster)
+	}
+	return selected
+}
+
+func sortClusters(clusters []*LogCluster, order ClusterSortOrder) []*LogCluster {
+	type sortKey struct {
+		cluster  *LogCluster
+		id       int64
+		size     int64
+		lastSeen time.Time
+	}
+	keys := make([]sortKey, 0, len(clusters))
+	for _, cluster := range clusters {
+		cluster.mu.RLock()
+		keys = append(keys, sortKey{
+			cluster:  cluster,
+			id:       cluster.id,
+			size:     cluster.size,
+			lastSeen: cluster.lastSeen,
+		})
+		cluster.mu.RUnlock()
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		switch order {
+		case CLUSTER_SORT_BY_SIZE:
+			if keys[i].size != keys[j].size {
+				return keys[i].size > keys[j].size
+			}
+		case CLUSTER_SORT_BY_LAST_SEEN:
+			if !keys[i].lastSeen.Equal(keys[j].lastSeen) {
+				return keys[i].lastSeen.After(keys[j].lastSeen)
+			}
+		}
+		return keys[i].id < keys[j].id
+	})
+	sorted := make([]*LogCluster, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, key.cluster)
+	}
+	return sorted
+}
@@ -0,0 +1,79 @@
+package loggingdrain
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clusterIDs(clusters []*LogCluster) []int64 {
+	ids := []int64{}
+	for _, cluster := range clusters {
+		ids = append(ids, cluster.ID())
+	}
+	return ids
+}
+
+func TestClusterQuery(t *testing.T) {
+	now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	miner, _ := NewTemplateMiner(WithClock(func() time.Time { return now }))
+	for _, log := range []string{
+		"disk sda full",
+		"user alice logged in",
+		"user bob logged in",
+		"user carol logged in",
+		"job 1 finished in 3 seconds",
+		"job 2 finished in 5 seconds",
+	} {
+		miner.AddLogMessage(log)
+		now = now.Add(time.Second)
+	}
+	miner.AddLogMessage("disk sda full")
+
+	t.Run("test list clusters", func(t *testing.T) {
+		assert.Equal(t, []int64{1, 2, 3}, clusterIDs(miner.Clusters(CLUSTER_SORT_BY_ID)))
+		assert.Equal(t, []int64{2, 1, 3}, clusterIDs(miner.Clusters(CLUSTER_SORT_BY_SIZE)))
+		assert.Equal(t, []int64{1, 3, 2}, clusterIDs(miner.Clusters(CLUSTER_SORT_BY_LAST_SEEN)))
+	})
+	t.Run("test get cluster", func(t *testing.T) {
+		cluster := miner.GetCluster(2)
+		assert.Equal(t, int64(2), cluster.ID())
+		assert.Equal(t, "user [*] logged in", cluster.Template())
+		assert.Equal(t, []string{"user", "[*]", "logged", "in"}, cluster.Tokens())
+		assert.Nil(t, miner.GetCluster(42))
+	})
+	t.Run("test tokens are copied", func(t *testing.T) {
+		cluster := miner.GetCluster(1)
+		tokens := cluster.Tokens()
+		tokens[0] = "changed"
+		assert.Equal(t, "disk sda full", cluster.Template())
+	})
+	t.Run("test find clusters", func(t *testing.T) {
+		byLength := miner.FindClusters(ClusterFilter{TokenCount: 4}, CLUSTER_SORT_BY_ID)
+		assert.Equal(t, []int64{2}, clusterIDs(byLength))
+		bySubstring := miner.FindClusters(ClusterFilter{Contains: "finished"}, CLUSTER_SORT_BY_ID)
+		assert.Equal(t, []int64{3}, clusterIDs(bySubstring))
+		byPattern := miner.FindClusters(ClusterFilter{Pattern: regexp.MustCompile(`^(disk|user) `)}, CLUSTER_SORT_BY_ID)
+		assert.Equal(t, []int64{1, 2}, clusterIDs(byPattern))
+		none := miner.FindClusters(ClusterFilter{TokenCount: 3, Contains: "user"}, CLUSTER_SORT_BY_ID)
+		assert.Empty(t, none)
+	})
+	t.Run("test sharded clusters", func(t *testing.T) {
+		sharded, _ := NewShardedTemplateMiner(3)
+		sharded.AddLogMessage("a")
+		sharded.AddLogMessage("a b")
+		sharded.AddLogMessage("a b c")
+		sharded.AddLogMessage("a b d")
+		clusters := sharded.Clusters(CLUSTER_SORT_BY_SIZE)
+		assert.Len(t, clusters, 3)
+		assert.Equal(t, "a b [*]", clusters[0].Template())
+		for _, cluster := range clusters {
+			assert.Equal(t, cluster, sharded.GetCluster(cluster.ID()))
+		}
+		found := sharded.FindClusters(ClusterFilter{TokenCount: 2}, CLUSTER_SORT_BY_ID)
+		assert.Len(t, found, 1)
+		assert.Nil(t, sharded.GetCluster(100))
+	})
+}
@@ -1,8 +1,15 @@
 package loggingdrain
 
+import "time"
+
 type minerConfig struct {
 	Mask  maskConfig
 	Drain drainConfig
+
+	// Persistence restores the miner at construction when set.
+	Persistence PersistenceHandler
+	// Seeds are added to the miner at construction.
+	Seeds []SeedTemplate
 }
 
 type drainConfig struct {
@@ -10,6 +17,18 @@ type drainConfig struct {
 	Depth       int
 	MaxChildren int
 	MaxCluster  int
+
+	ClusterIDOffset int64
+	ClusterIDStride int64
+
+	EvictionPolicy EvictionPolicy
+	OnEvict        func(*LogCluster)
+
+	HistorySize int
+
+	Tokenizer tokenizer
+
+	Clock func() time.Time
 }
 
 type maskConfig struct {
@@ -21,4 +40,10 @@ type maskConfig struct {
 type maskInstruction struct {
 	Pattern  string
 	MaskWith string
+	Priority int
+	// Preset replaces Pattern and MaskWith with those of a built-in
+	// instruction.
+	Preset MaskPreset
+	// Masker is the registered name of the Masker replacing Pattern.
+	Masker string
 }
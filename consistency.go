@@ -0,0 +1,104 @@
+package loggingdrain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// max_consistency_problems limits the problems listed in a ConsistencyError.
+const max_consistency_problems = 10
+
+// CheckConsistency validates the internal state of the miner: every cluster
+// of the prefix tree is the cluster of its id in the cache, and every cluster
+// of the cache is reachable once from each of its leaves in the tree, under
+// the node of its length.
+// A ConsistencyError lists the problems found.
+func (miner *TemplateMiner) CheckConsistency() error {
+	return miner.drain.checkConsistency()
+}
+
+// CheckConsistency validates the internal state of every shard.
+func (miner *ShardedTemplateMiner) CheckConsistency() error {
+	for i, shard := range miner.shards {
+		if err := shard.checkConsistency(); err != nil {
+			return withMessagef(err, "shard %d", i)
+		}
+	}
+	return nil
+}
+
+func (drain *drain) checkConsistency() error {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+
+	problems := []string{}
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	reachable := map[*LogCluster]int{}
+	for length, lengthNode := range drain.rootNode.lengthNodeChildren {
+		stack := newTreeNodes().push(lengthNode)
+		for len(stack) > 0 {
+			var node *treeNode
+			stack, node = stack.pop()
+			for _, cluster := range node.clusters {
+				reachable[cluster] += 1
+				cluster.mu.RLock()
+				id, tokenCount := cluster.id, len(cluster.logTemplateTokens)
+				cluster.mu.RUnlock()
+				if tokenCount != length {
+					report("cluster %d with %d tokens under the length node %d", id, tokenCount, length)
+				}
+				if !containsNode(cluster.leaves, node) {
+					report("tree cluster %d does not refer to its node", id)
+				}
+				cached, ok := drain.idToCluster.Peek(id)
+				if !ok {
+					report("tree cluster %d is not in the cache", id)
+				} else if cached != cluster {
+					report("tree cluster %d is not the cached cluster of its id", id)
+				}
+			}
+			for _, child := range node.tokenNodeChildren {
+				stack = stack.push(child)
+			}
+		}
+	}
+
+	for _, id := range drain.idToCluster.Keys() {
+		cluster, ok := drain.idToCluster.Peek(id)
+		if !ok {
+			continue
+		}
+		if cluster.ID() != id {
+			report("cache key %d holds cluster %d", id, cluster.ID())
+		}
+		switch reachable[cluster] {
+		case 0:
+			report("cached cluster %d is not reachable in the tree", id)
+		case len(cluster.leaves):
+		default:
+			report("cached cluster %d is reachable %d times in the tree from %d leaves",
+				id, reachable[cluster], len(cluster.leaves))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > max_consistency_problems {
+		problems = append(problems[:max_consistency_problems],
+			fmt.Sprintf("and %d more", len(problems)-max_consistency_problems))
+	}
+	return errConsistencyRaw(strings.Join(problems, "; "))
+}
+
+func containsNode(nodes []*treeNode, node *treeNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	t.Run("test consistent miner", func(t *testing.T) {
+		miner := newTestMiner(t, len(testData))
+		assert.Nil(t, miner.CheckConsistency())
+
+		small, _ := NewTemplateMiner(WithDrainMaxCluster(5))
+		for _, log := range testData {
+			small.AddLogMessage(log)
+		}
+		assert.Nil(t, small.CheckConsistency())
+
+		sharded, _ := NewShardedTemplateMiner(4)
+		for _, log := range testData {
+			sharded.AddLogMessage(log)
+		}
+		assert.Nil(t, sharded.CheckConsistency())
+	})
+	t.Run("test loaded tree shares the clusters", func(t *testing.T) {
+		for _, snapshot := range []string{testMinerJsonV1, testMinerJson} {
+			loaded := TemplateMiner{}
+			if err := json.Unmarshal([]byte(snapshot), &loaded); err != nil {
+				t.Fatal(err)
+			}
+			assert.Nil(t, loaded.CheckConsistency())
+			treeClusters := loaded.drain.getClustersForSeqLen(10)
+			assert.Len(t, treeClusters, 1)
+			assert.Same(t, loaded.GetCluster(1), treeClusters[0])
+
+			response := loaded.AddLogMessage("Dec 10 07:07:38 LabSZ sshd[24206]: input_userauth_request: valid user test9 [preauth]")
+			assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, response.ChangeType)
+			assert.Equal(t, response.Cluster.Template(), loaded.GetCluster(1).Template())
+			assert.Nil(t, loaded.CheckConsistency())
+		}
+	})
+	t.Run("test inconsistent miner", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		miner.drain.idToCluster.Add(1, miner.drain.getCluster(1).clone())
+		err := miner.CheckConsistency()
+		assert.True(t, errorIs(err, consistencyError))
+		assert.Contains(t, err.Error(), "tree cluster 1 is not the cached cluster of its id")
+		assert.Contains(t, err.Error(), "cached cluster 1 is not reachable in the tree")
+
+		miner = newTestMinerJsonMiner()
+		miner.drain.idToCluster.Add(3, miner.drain.getCluster(2))
+		err = miner.CheckConsistency()
+		assert.Contains(t, err.Error(), "cache key 3 holds cluster 2")
+	})
+}
@@ -5,8 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
-
-	lru "github.com/hashicorp/golang-lru/v2"
+	"time"
 )
 
 type SearchStrategy int
@@ -23,6 +22,16 @@ const (
 	CLUSTER_UPDATE_TYPE_NONE ClusterUpdateType = iota
 	CLUSTER_UPDATE_TYPE_NEW_CLUSTER
 	CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER
+	// CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED reports a cluster that took the
+	// id of a remote replica, see TemplateSync. Its template may have been
+	// updated too.
+	CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED
+	// CLUSTER_UPDATE_TYPE_DELETE_CLUSTER reports a cluster removed by
+	// DeleteCluster.
+	CLUSTER_UPDATE_TYPE_DELETE_CLUSTER
+	// CLUSTER_UPDATE_TYPE_UPDATE_METADATA reports a cluster pinned, unpinned
+	// or named, its template is unchanged.
+	CLUSTER_UPDATE_TYPE_UPDATE_METADATA
 )
 
 const (
@@ -39,10 +48,32 @@ type drain struct {
 	maxChildren int
 	maxClusters int
 
-	mu             sync.Mutex
-	idToCluster    *lru.Cache[int64, *LogCluster]
+	// cluster ids are clusterIDOffset+1, clusterIDOffset+1+clusterIDStride, ...
+	// so that drains sharing an id space never assign the same id.
+	clusterIDOffset int64
+	clusterIDStride int64
+
+	// clock returns the time log messages are seen at, time.Now when nil.
+	clock func() time.Time
+
+	// evictionPolicy chooses the clusters evicted from the cache, onEvict is
+	// called with them once the lock is released.
+	evictionPolicy EvictionPolicy
+	onEvict        func(*LogCluster)
+
+	// historySize bounds the template changes kept per cluster, the default
+	// is used when lower than one.
+	historySize int
+	tokenizer   tokenizer
+
+	// mu guards the prefix tree, the cluster cache, the cluster counter and
+	// the templates of the clusters. evicted holds the clusters evicted by
+	// the current write.
+	mu             sync.RWMutex
+	idToCluster    *clusterCache
 	clusterCounter int64
 	rootNode       *treeNode
+	evicted        []*LogCluster
 }
 
 type drainMarshalStruct struct {
@@ -51,22 +82,36 @@ type drainMarshalStruct struct {
 	MaxChildren int
 	MaxClusters int
 
+	ClusterIDOffset int64          `json:",omitempty"`
+	ClusterIDStride int64          `json:",omitempty"`
+	EvictionPolicy  EvictionPolicy `json:",omitempty"`
+	HistorySize     int            `json:",omitempty"`
+
+	Tokenizer *tokenizerMarshalStruct `json:",omitempty"`
+
 	ClusterCounter int64
 	Clusters       []*LogCluster
-	RootNode       *treeNode
 }
 
+// MarshalJSON encodes the configuration and the clusters of the drain, from
+// the least to the most recently used. The prefix tree is not encoded, it is
+// rebuilt from the clusters by UnmarshalJSON.
 func (drain *drain) MarshalJSON() ([]byte, error) {
-	clusters := []*LogCluster{}
-	clusters = append(clusters, drain.idToCluster.Values()...)
+	clusters, counter := drain.snapshotClusters()
 	marshalStruct := drainMarshalStruct{
 		MaxDepth:       drain.maxDepth,
 		Sim:            drain.sim,
 		MaxChildren:    drain.maxChildren,
 		MaxClusters:    drain.maxClusters,
+		EvictionPolicy: drain.evictionPolicy,
+		HistorySize:    drain.historySize,
+		Tokenizer:      drain.tokenizer.marshalStruct(),
 		Clusters:       clusters,
-		RootNode:       drain.rootNode,
-		ClusterCounter: drain.clusterCounter,
+		ClusterCounter: counter,
+	}
+	if drain.clusterIDStride > 1 || drain.clusterIDOffset > 0 {
+		marshalStruct.ClusterIDOffset = drain.clusterIDOffset
+		marshalStruct.ClusterIDStride = drain.clusterIDStride
 	}
 	return json.Marshal(&marshalStruct)
 }
@@ -77,55 +122,199 @@ func (drain *drain) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	l, _ := lru.New[int64, *LogCluster](marshalStruct.MaxClusters)
+	tokenizer, err := tokenizerFromMarshalStruct(marshalStruct.Tokenizer)
+	if err != nil {
+		return err
+	}
+	restored := newDrainWithConfig(drainConfig{
+		Similarity:      marshalStruct.Sim,
+		Depth:           marshalStruct.MaxDepth,
+		MaxChildren:     marshalStruct.MaxChildren,
+		MaxCluster:      marshalStruct.MaxClusters,
+		ClusterIDOffset: marshalStruct.ClusterIDOffset,
+		ClusterIDStride: marshalStruct.ClusterIDStride,
+		EvictionPolicy:  marshalStruct.EvictionPolicy,
+		HistorySize:     marshalStruct.HistorySize,
+		Tokenizer:       tokenizer,
+	})
+	restored.clusterCounter = marshalStruct.ClusterCounter
 	for _, cluster := range marshalStruct.Clusters {
-		l.Add(cluster.id, cluster)
+		if cluster == nil {
+			return errSnapshotCorruptedRaw("snapshot with a null cluster")
+		}
 	}
-
-	drain.clusterCounter = marshalStruct.ClusterCounter
-	drain.idToCluster = l
-	drain.maxChildren = marshalStruct.MaxChildren
-	drain.maxClusters = marshalStruct.MaxClusters
-	drain.maxDepth = marshalStruct.MaxDepth
-	drain.mu = sync.Mutex{}
-	drain.rootNode = marshalStruct.RootNode
-	drain.sim = marshalStruct.Sim
+	restored.restoreClusters(marshalStruct.Clusters)
+
+	drain.maxDepth = restored.maxDepth
+	drain.sim = restored.sim
+	drain.maxChildren = restored.maxChildren
+	drain.maxClusters = restored.maxClusters
+	drain.clusterIDOffset = restored.clusterIDOffset
+	drain.clusterIDStride = restored.clusterIDStride
+	drain.evictionPolicy = restored.evictionPolicy
+	drain.historySize = restored.historySize
+	drain.tokenizer = restored.tokenizer
+	drain.mu = sync.RWMutex{}
+	drain.idToCluster = restored.idToCluster
+	drain.clusterCounter = restored.clusterCounter
+	drain.rootNode = restored.rootNode
 	return nil
 }
 
+// snapshotClusters returns a copy of the clusters from the least to the most
+// recently used, and the cluster counter.
+func (drain *drain) snapshotClusters() ([]*LogCluster, int64) {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	clusters := make([]*LogCluster, 0, drain.idToCluster.Len())
+	for _, id := range drain.idToCluster.Keys() {
+		if cluster, ok := drain.idToCluster.Peek(id); ok {
+			clusters = append(clusters, cluster.clone())
+		}
+	}
+	return clusters, drain.clusterCounter
+}
+
+// restoreClusters adds clusters to the LRU and rebuilds their path in the
+// prefix tree, clusters are ordered from the least to the most recently used.
+func (drain *drain) restoreClusters(clusters []*LogCluster) {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+	for _, cluster := range clusters {
+		drain.reserveClusterID(cluster.id)
+		drain.addSeqToPrefixTree(drain.rootNode, cluster)
+		drain.cacheCluster(cluster.id, cluster)
+	}
+	// the clusters exceeding the capacity are dropped silently
+	drain.evicted = nil
+}
+
 func (drain *drain) status() string {
-	countStr := fmt.Sprintf("cluster count %v", drain.idToCluster.Len())
+	return formatStatus(drain.templates())
+}
 
-	clustersStr := []string{}
+// templates returns the templates of the clusters from the least to the
+// most recently used.
+func (drain *drain) templates() []string {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	templates := []string{}
 	for _, clusterKey := range drain.idToCluster.Keys() {
-		cluster, _ := drain.idToCluster.Get(clusterKey)
-		clustersStr = append(clustersStr, fmt.Sprintf("%s\n", cluster.getTemplate()))
+		cluster, ok := drain.idToCluster.Peek(clusterKey)
+		if !ok {
+			continue
+		}
+		templates = append(templates, cluster.getTemplate())
+	}
+	return templates
+}
+
+func formatStatus(templates []string) string {
+	countStr := fmt.Sprintf("cluster count %v", len(templates))
+
+	clustersStr := []string{}
+	for _, template := range templates {
+		clustersStr = append(clustersStr, fmt.Sprintf("%s\n", template))
 	}
 
 	status := fmt.Sprintf("%s\n%s", countStr, strings.Join(clustersStr, "\n"))
 	return status
 }
 
-func (drain *drain) addLogMessage(message string) (*LogCluster, ClusterUpdateType) {
-	tokens := getStringTokens(message)
+func (drain *drain) addLogMessage(message string) *LogMessageResponse {
+	return drain.addLogTokens(drain.tokenize(message))
+}
+
+// tokenize splits a masked message or a template into tokens.
+func (drain *drain) tokenize(message string) []string {
+	return drain.tokenizer.tokenize(message)
+}
+
+// addLogTokens adds tokens and returns the response without the cluster
+// count, which is up to the miner.
+func (drain *drain) addLogTokens(tokens []string) *LogMessageResponse {
+	now := drain.now()
+	drain.mu.Lock()
+	response := drain.addLogTokensLocked(tokens, now)
+	evicted := drain.takeEvicted()
+	drain.mu.Unlock()
+	drain.notifyEvicted(evicted)
+	return response
+}
+
+// addLogTokensLocked builds the response while it holds the cluster lock, so
+// that it reflects this very log message and not the concurrent ones.
+func (drain *drain) addLogTokensLocked(tokens []string, now time.Time) *LogMessageResponse {
 	cluster := drain.treeSearch(drain.rootNode, tokens, drain.sim, false)
 	if cluster == nil {
-		drain.clusterCounter += 1
-		id := drain.clusterCounter
+		id := drain.nextClusterID()
 		cluster = newLogCluster(id, tokens)
-		drain.idToCluster.Add(id, cluster)
+		cluster.seen(now)
 		drain.addSeqToPrefixTree(drain.rootNode, cluster)
-		return cluster, CLUSTER_UPDATE_TYPE_NEW_CLUSTER
+		drain.cacheCluster(id, cluster)
+		return newLogMessageResponse(cluster, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, nil)
 	}
-	updatedTemplate, err := drain.updateTemplate(tokens, cluster.logTemplateTokens)
-	if err != nil {
-		return cluster, CLUSTER_UPDATE_TYPE_NONE
+	cluster.mu.Lock()
+	cluster.seen(now)
+	var previous []string
+	var err error
+	if !cluster.locked {
+		previous, err = drain.generalizeTemplate(cluster, tokens, now)
+	}
+	updateType := CLUSTER_UPDATE_TYPE_NONE
+	if err == nil && previous != nil {
+		updateType = CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER
+	}
+	response := newLogMessageResponse(cluster, updateType, previous)
+	cluster.mu.Unlock()
+	drain.idToCluster.Update(cluster.id)
+	if updateType == CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER {
+		drain.idToCluster.Get(cluster.id)
+	}
+	return response
+}
+
+// cacheCluster adds cluster to the cache and prunes the clusters it evicts
+// from the tree, the write lock must be held.
+func (drain *drain) cacheCluster(id int64, cluster *LogCluster) {
+	for _, evicted := range drain.idToCluster.Add(id, cluster) {
+		drain.pruneCluster(evicted)
+		drain.evicted = append(drain.evicted, evicted)
+	}
+}
+
+// pruneCluster removes cluster from its leaves of the prefix tree.
+func (drain *drain) pruneCluster(cluster *LogCluster) {
+	if cluster == nil {
+		return
+	}
+	for _, leaf := range cluster.leaves {
+		leaf.removeCluster(cluster)
+	}
+	cluster.leaves = nil
+}
+
+// takeEvicted returns the clusters evicted since the last call, the write
+// lock must be held.
+func (drain *drain) takeEvicted() []*LogCluster {
+	evicted := drain.evicted
+	drain.evicted = nil
+	return evicted
+}
+
+func (drain *drain) notifyEvicted(evicted []*LogCluster) {
+	if drain.onEvict == nil {
+		return
 	}
-	if !updatedTemplate {
-		return cluster, CLUSTER_UPDATE_TYPE_NONE
+	for _, cluster := range evicted {
+		drain.onEvict(cluster)
 	}
-	drain.idToCluster.Get(cluster.id)
-	return cluster, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER
+}
+
+func (drain *drain) clusterCount() int {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	return drain.idToCluster.Len()
 }
 
 // match log message against an already existing cluster.
@@ -147,8 +336,27 @@ func (drain *drain) addLogMessage(message string) (*LogCluster, ClusterUpdateTyp
 //
 // :return: Matched cluster or None if no match found.
 func (drain *drain) match(content string, strategy SearchStrategy) *LogCluster {
-	tokens := getStringTokens(content)
-	requireSim := float32(1)
+	cluster, _, _ := drain.matchTokens(drain.tokenize(content), strategy, 1)
+	return cluster
+}
+
+// matchTokens is match with a custom required similarity, it also returns the
+// similarity and the wildcard parameter count of the matched cluster.
+func (drain *drain) matchTokens(tokens []string, strategy SearchStrategy, requireSim float32) (*LogCluster, float32, int64) {
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+	cluster := drain.matchCluster(tokens, strategy, requireSim)
+	if cluster == nil {
+		return nil, 0, 0
+	}
+	sim, paramCount, err := drain.getSeqDistance(cluster.logTemplateTokens, tokens, true)
+	if err != nil {
+		return nil, 0, 0
+	}
+	return cluster, sim, paramCount
+}
+
+func (drain *drain) matchCluster(tokens []string, strategy SearchStrategy, requireSim float32) *LogCluster {
 	fullMatch := func() *LogCluster {
 		clusters := drain.getClustersForSeqLen(len(tokens))
 		cluster := drain.fastMatch(clusters, tokens, requireSim, true)
@@ -178,12 +386,24 @@ func (drain *drain) match(content string, strategy SearchStrategy) *LogCluster {
 	}
 }
 
+func (drain *drain) nextClusterID() int64 {
+	drain.clusterCounter += 1
+	return (drain.clusterCounter-1)*drain.clusterIDStride + drain.clusterIDOffset + 1
+}
+
+func (drain *drain) now() time.Time {
+	if drain.clock == nil {
+		return time.Now()
+	}
+	return drain.clock()
+}
+
 func (drain *drain) getMaxNodeDepth() int {
 	return drain.maxDepth - 2
 }
 
 func (drain *drain) GetTotalClusterSize() int {
-	return drain.idToCluster.Len()
+	return drain.clusterCount()
 }
 
 func (drain *drain) treeSearch(
@@ -279,17 +499,12 @@ func (drain *drain) addSeqToPrefixTree(rootNode *treeNode, cluster *LogCluster)
 	currentDepth := 1
 	if tokenCount == 0 {
 		currentNode.clusters = []*LogCluster{cluster}
+		cluster.leaves = append(cluster.leaves, currentNode)
 	}
 	for _, token := range cluster.logTemplateTokens {
 		if currentDepth >= drain.getMaxNodeDepth() || currentDepth >= tokenCount {
-			newClusters := []*LogCluster{}
-			for _, c := range currentNode.clusters {
-				if drain.idToCluster.Contains(c.id) {
-					newClusters = append(newClusters, c)
-				}
-			}
-			newClusters = append(newClusters, cluster)
-			currentNode.clusters = newClusters
+			currentNode.clusters = append(currentNode.clusters, cluster)
+			cluster.leaves = append(cluster.leaves, currentNode)
 			break
 		}
 		node, containsInChildren := currentNode.tokenNodeChildren[token]
@@ -346,6 +561,9 @@ func (drain *drain) fastMatch(clusters []*LogCluster, tokens []string, requireSi
 		if !drain.idToCluster.Contains(cluster.id) {
 			continue
 		}
+		if cluster.locked && !templateFits(cluster.logTemplateTokens, tokens) {
+			continue
+		}
 		sim, paramCount, err := drain.getSeqDistance(cluster.logTemplateTokens, tokens, includeParams)
 		if err != nil {
 			continue
@@ -387,6 +605,20 @@ func (drain *drain) getClustersForSeqLen(length int) []*LogCluster {
 	return clusters
 }
 
+// templateFits reports whether tokens match template without generalizing
+// it, every token is equal to the template token or replaced by a wildcard.
+func templateFits(template, tokens []string) bool {
+	if len(template) != len(tokens) {
+		return false
+	}
+	for i, token := range template {
+		if token != default_wildcard_str && token != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (drain *drain) getSeqDistance(seq1, seq2 []string, includeParams bool) (float32, int64, error) {
 	if len(seq1) != len(seq2) {
 		return 0, 0, errInternalRaw(
@@ -424,18 +656,29 @@ func newDrainWithConfig(conf drainConfig) *drain {
 	if conf.MaxCluster > 0 {
 		maxCluster = conf.MaxCluster
 	}
-	l, _ := lru.New[int64, *LogCluster](maxCluster)
+	idStride := int64(1)
+	if conf.ClusterIDStride > 0 {
+		idStride = conf.ClusterIDStride
+	}
 
-	return &drain{
-		maxDepth:       conf.Depth,
-		sim:            conf.Similarity,
-		maxChildren:    conf.MaxChildren,
-		maxClusters:    conf.MaxCluster,
-		mu:             sync.Mutex{},
-		idToCluster:    l,
-		clusterCounter: 0,
-		rootNode:       newRootTreeNode(),
+	drain := &drain{
+		maxDepth:        conf.Depth,
+		sim:             conf.Similarity,
+		maxChildren:     conf.MaxChildren,
+		maxClusters:     maxCluster,
+		clusterIDOffset: conf.ClusterIDOffset,
+		clusterIDStride: idStride,
+		clock:           conf.Clock,
+		evictionPolicy:  conf.EvictionPolicy,
+		onEvict:         conf.OnEvict,
+		historySize:     conf.HistorySize,
+		tokenizer:       conf.Tokenizer,
+		mu:              sync.RWMutex{},
+		clusterCounter:  0,
+		rootNode:        newRootTreeNode(),
 	}
+	drain.idToCluster = newClusterCache(maxCluster, conf.EvictionPolicy)
+	return drain
 }
 
 func withDepth(depth int) drainOption {
@@ -459,6 +702,44 @@ func withMaxChildren(maxChildren int) drainOption {
 	})
 }
 
+// withClusterIDSpace makes the drain assign the ids offset+1,
+// offset+1+stride, offset+1+2*stride, ...
+func withClusterIDSpace(offset, stride int64) drainOption {
+	return drainOptionFunc(func(conf drainConfig) drainConfig {
+		conf.ClusterIDOffset = offset
+		conf.ClusterIDStride = stride
+		return conf
+	})
+}
+
+func withEvictionPolicy(policy EvictionPolicy) drainOption {
+	return drainOptionFunc(func(conf drainConfig) drainConfig {
+		conf.EvictionPolicy = policy
+		return conf
+	})
+}
+
+func withEvictionCallback(onEvict func(*LogCluster)) drainOption {
+	return drainOptionFunc(func(conf drainConfig) drainConfig {
+		conf.OnEvict = onEvict
+		return conf
+	})
+}
+
+func withHistorySize(size int) drainOption {
+	return drainOptionFunc(func(conf drainConfig) drainConfig {
+		conf.HistorySize = size
+		return conf
+	})
+}
+
+func withClock(clock func() time.Time) drainOption {
+	return drainOptionFunc(func(conf drainConfig) drainConfig {
+		conf.Clock = clock
+		return conf
+	})
+}
+
 func withMaxClusters(maxCluster int) drainOption {
 	return drainOptionFunc(func(conf drainConfig) drainConfig {
 		conf.MaxCluster = maxCluster
@@ -27,7 +27,7 @@ func TestAddLogMessage(t *testing.T) {
 		}
 		drain := newDrain()
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
@@ -40,11 +40,11 @@ func TestAddLogMessage(t *testing.T) {
 	})
 	t.Run("add short message", func(t *testing.T) {
 		model := newDrain()
-		_, updateType := model.addLogMessage("hello")
+		updateType := model.addLogMessage("hello").ChangeType
 		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, updateType)
-		_, updateType = model.addLogMessage("hello")
+		updateType = model.addLogMessage("hello").ChangeType
 		assert.Equal(t, CLUSTER_UPDATE_TYPE_NONE, updateType)
-		_, updateType = model.addLogMessage("otherword")
+		updateType = model.addLogMessage("otherword").ChangeType
 		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, updateType)
 	})
 	t.Run("add log message sim75", func(t *testing.T) {
@@ -66,7 +66,7 @@ func TestAddLogMessage(t *testing.T) {
 		}
 		drain := newDrain(withSim(0.75))
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
@@ -87,7 +87,7 @@ func TestAddLogMessage(t *testing.T) {
 		}
 		drain := newDrain(withMaxClusters(1))
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
@@ -127,7 +127,7 @@ func TestAddLogMessage(t *testing.T) {
 		}
 		drain := newDrain(withMaxClusters(2))
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
@@ -153,7 +153,7 @@ func TestDepth5AddLogMessage(t *testing.T) {
 		}
 		drain := newDrain(withDepth(5))
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
@@ -176,7 +176,7 @@ func TestDepth5AddLogMessage(t *testing.T) {
 		}
 		drain := newDrain(withSim(0.75))
 		for i, rawLog := range rawLogs {
-			cluster, _ := drain.addLogMessage(rawLog)
+			cluster := drain.addLogMessage(rawLog).Cluster
 			assert.Equal(t, expected[i], cluster.getTemplate())
 		}
 	})
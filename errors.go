@@ -7,21 +7,69 @@ import (
 const (
 	maskPatternCompileErrMsg = "compile mask pattern error"
 	internalErrMsg           = "internal error"
+	templateMismatchErrMsg   = "template mismatch error"
+	snapshotCorruptedErrMsg  = "snapshot corrupted error"
+	snapshotNotFoundErrMsg   = "snapshot not found error"
+	clusterIDConflictErrMsg  = "cluster id conflict error"
+	snapshotVersionErrMsg    = "snapshot version error"
+	consistencyErrMsg        = "consistency error"
+	clusterNotFoundErrMsg    = "cluster not found error"
+	tokenizerErrMsg          = "tokenizer error"
 )
 
 var (
 	maskPatternCompileError = MaskPatternError{}
 	internalError           = InternalError{}
+	templateMismatchError   = TemplateMismatchError{}
+	snapshotCorruptedError  = SnapshotCorruptedError{}
+	snapshotNotFoundError   = SnapshotNotFoundError{}
+	clusterIDConflictError  = ClusterIDConflictError{}
+	snapshotVersionError    = SnapshotVersionError{}
+	consistencyError        = ConsistencyError{}
+	clusterNotFoundError    = ClusterNotFoundError{}
+	tokenizerError          = TokenizerError{}
 )
 
 type MaskPatternError struct{}
 
 type InternalError struct{}
 
+type TemplateMismatchError struct{}
+
+type SnapshotCorruptedError struct{}
+
+type SnapshotNotFoundError struct{}
+
+type ClusterIDConflictError struct{}
+
+type SnapshotVersionError struct{}
+
+type ConsistencyError struct{}
+
+type ClusterNotFoundError struct{}
+
+type TokenizerError struct{}
+
 func (MaskPatternError) Error() string { return maskPatternCompileErrMsg }
 
 func (InternalError) Error() string { return internalErrMsg }
 
+func (TemplateMismatchError) Error() string { return templateMismatchErrMsg }
+
+func (SnapshotCorruptedError) Error() string { return snapshotCorruptedErrMsg }
+
+func (SnapshotNotFoundError) Error() string { return snapshotNotFoundErrMsg }
+
+func (ClusterIDConflictError) Error() string { return clusterIDConflictErrMsg }
+
+func (SnapshotVersionError) Error() string { return snapshotVersionErrMsg }
+
+func (ConsistencyError) Error() string { return consistencyErrMsg }
+
+func (ClusterNotFoundError) Error() string { return clusterNotFoundErrMsg }
+
+func (TokenizerError) Error() string { return tokenizerErrMsg }
+
 func wrapErr(wrapedErr error, err error) error {
 	if err == nil {
 		return pkgerrors.Wrap(wrapedErr, "")
@@ -73,3 +121,54 @@ func errInternalf(err error, format string, args ...interface{}) error {
 func errInternalRaw(message string) error {
 	return wrapErr(internalError, pkgerrors.New(message))
 }
+
+func errTemplateMismatchRaw(message string) error {
+	return wrapErr(templateMismatchError, pkgerrors.New(message))
+}
+
+func errSnapshotCorrupted(err error) error {
+	return wrapErr(snapshotCorruptedError, err)
+}
+
+func errSnapshotCorruptedRaw(message string) error {
+	return wrapErr(snapshotCorruptedError, pkgerrors.New(message))
+}
+
+func errSnapshotNotFound(err error) error {
+	return wrapErr(snapshotNotFoundError, err)
+}
+
+func errSnapshotNotFoundRaw(message string) error {
+	return wrapErr(snapshotNotFoundError, pkgerrors.New(message))
+}
+
+func errClusterIDConflictRaw(message string) error {
+	return wrapErr(clusterIDConflictError, pkgerrors.New(message))
+}
+
+func errSnapshotVersionRaw(message string) error {
+	return wrapErr(snapshotVersionError, pkgerrors.New(message))
+}
+
+func errConsistencyRaw(message string) error {
+	return wrapErr(consistencyError, pkgerrors.New(message))
+}
+
+func errClusterNotFoundRaw(message string) error {
+	return wrapErr(clusterNotFoundError, pkgerrors.New(message))
+}
+
+func errTokenizerRaw(message string) error {
+	return wrapErr(tokenizerError, pkgerrors.New(message))
+}
+
+// errSnapshotUnmarshal keeps the snapshot errors returned while decoding a
+// snapshot and the tokenizer errors, which depend on the process loading it.
+// Any other error means the snapshot is corrupted.
+func errSnapshotUnmarshal(err error) error {
+	if errorIs(err, snapshotVersionError) || errorIs(err, snapshotCorruptedError) ||
+		errorIs(err, tokenizerError) {
+		return err
+	}
+	return errSnapshotCorrupted(err)
+}
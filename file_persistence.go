@@ -0,0 +1,334 @@
+package loggingdrain
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	default_snapshot_retention = 3
+
+	snapshot_file_magic       = "loggingdrain-snapshot"
+	snapshot_file_version     = 1
+	snapshot_file_suffix      = ".snapshot"
+	snapshot_encoding_json    = "json"
+	snapshot_encoding_binary  = "binary"
+	snapshot_compression_none = "none"
+	snapshot_compression_gzip = "gzip"
+)
+
+// FilePersistence saves the miner in a directory, one file per snapshot.
+//
+// A snapshot is written to a temporary file which is renamed once complete,
+// so a crash never leaves a partial snapshot behind. Only the latest
+// snapshots are kept. Every snapshot starts with a header line holding the
+// sha256 checksum of its payload, which is verified on Load.
+type FilePersistence struct {
+	dir       string
+	name      string
+	retention int
+	compress  bool
+	encoding  SnapshotEncoding
+
+	// mu serializes the saves of this process.
+	mu sync.Mutex
+}
+
+var _ PersistenceHandler = &FilePersistence{}
+
+// NewFilePersistence creates a handler saving the snapshots of name in dir.
+func NewFilePersistence(dir, name string, options ...filePersistenceOption) *FilePersistence {
+	conf := newFilePersistenceConfig(options)
+	return &FilePersistence{
+		dir:       dir,
+		name:      name,
+		retention: conf.Retention,
+		compress:  conf.Compress,
+		encoding:  conf.Encoding,
+	}
+}
+
+func (p *FilePersistence) Save(ctx context.Context, template *TemplateMiner) error {
+	if err := ctx.Err(); err != nil {
+		return errInternal(err)
+	}
+	b, err := encodeSnapshot(template, p.encoding)
+	if err != nil {
+		return err
+	}
+	encoding := snapshot_encoding_json
+	if p.encoding == SNAPSHOT_ENCODING_BINARY {
+		encoding = snapshot_encoding_binary
+	}
+	compression := snapshot_compression_none
+	if p.compress {
+		compression = snapshot_compression_gzip
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return errInternal(err)
+		}
+		if err := w.Close(); err != nil {
+			return errInternal(err)
+		}
+		b = buf.Bytes()
+	}
+	checksum := sha256.Sum256(b)
+	header := fmt.Sprintf("%s %d %s %s %s\n", snapshot_file_magic, snapshot_file_version,
+		encoding, compression, hex.EncodeToString(checksum[:]))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshots, err := p.snapshots()
+	if err != nil {
+		return err
+	}
+	sequence := int64(1)
+	if len(snapshots) > 0 {
+		sequence = snapshots[0].sequence + 1
+	}
+	if err := p.writeFile(p.snapshotPath(sequence), append([]byte(header), b...)); err != nil {
+		return err
+	}
+	return p.rotate()
+}
+
+// Load loads the latest snapshot which decodes, falling back to the older
+// snapshots kept when the latest ones are corrupted. The error of the latest
+// snapshot is returned when none decodes, a SnapshotCorruptedError when it
+// does not pass the integrity check, and a SnapshotNotFoundError when there
+// is no snapshot.
+func (p *FilePersistence) Load(ctx context.Context) (*TemplateMiner, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errInternal(err)
+	}
+	snapshots, err := p.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, errSnapshotNotFoundRaw(fmt.Sprintf("no snapshot of %s in %s", p.name, p.dir))
+	}
+	var latestErr error
+	for _, snapshot := range snapshots {
+		miner, err := p.loadFile(snapshot.path)
+		if err == nil {
+			return miner, nil
+		}
+		if latestErr == nil {
+			latestErr = err
+		}
+	}
+	return nil, latestErr
+}
+
+func (p *FilePersistence) loadFile(path string) (*TemplateMiner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, errSnapshotCorruptedRaw(fmt.Sprintf("read header of %s: %v", path, err))
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 5 || fields[0] != snapshot_file_magic {
+		return nil, errSnapshotCorruptedRaw(fmt.Sprintf("invalid header %q in %s", header, path))
+	}
+	if fields[1] != strconv.Itoa(snapshot_file_version) ||
+		(fields[2] != snapshot_encoding_json && fields[2] != snapshot_encoding_binary) {
+		return nil, errSnapshotCorruptedRaw(fmt.Sprintf("unsupported snapshot format %q in %s", header, path))
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	checksum := sha256.Sum256(payload)
+	if hex.EncodeToString(checksum[:]) != fields[4] {
+		return nil, errSnapshotCorruptedRaw(fmt.Sprintf("checksum mismatch in %s", path))
+	}
+
+	switch fields[3] {
+	case snapshot_compression_none:
+	case snapshot_compression_gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+		payload, err = io.ReadAll(gr)
+		if err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+	default:
+		return nil, errSnapshotCorruptedRaw(fmt.Sprintf("unknown compression %q in %s", fields[3], path))
+	}
+
+	if fields[2] == snapshot_encoding_binary {
+		miner := TemplateMiner{}
+		if err := miner.UnmarshalBinary(payload); err != nil {
+			return nil, errSnapshotUnmarshal(err)
+		}
+		return &miner, nil
+	}
+	miner := TemplateMiner{}
+	if err := json.Unmarshal(payload, &miner); err != nil {
+		return nil, errSnapshotUnmarshal(err)
+	}
+	return &miner, nil
+}
+
+// writeFile atomically replaces path with data.
+func (p *FilePersistence) writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		return errInternal(err)
+	}
+	tmp, err := os.CreateTemp(p.dir, "."+p.name+".tmp-*")
+	if err != nil {
+		return errInternal(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errInternal(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errInternal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errInternal(err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errInternal(err)
+	}
+	// make the rename durable, not every platform can sync a directory
+	if dir, err := os.Open(p.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// rotate removes the snapshots exceeding the retention.
+func (p *FilePersistence) rotate() error {
+	snapshots, err := p.snapshots()
+	if err != nil {
+		return err
+	}
+	for i := p.retention; i < len(snapshots); i++ {
+		if err := os.Remove(snapshots[i].path); err != nil && !os.IsNotExist(err) {
+			return errInternal(err)
+		}
+	}
+	return nil
+}
+
+type snapshotFile struct {
+	path     string
+	sequence int64
+}
+
+// snapshots returns the snapshots of the handler, latest first.
+func (p *FilePersistence) snapshots() ([]snapshotFile, error) {
+	entries, err := os.ReadDir(p.dir)
+	if os.IsNotExist(err) {
+		return []snapshotFile{}, nil
+	}
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	snapshots := []snapshotFile{}
+	prefix := p.name + "."
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(fileName, prefix) || !strings.HasSuffix(fileName, snapshot_file_suffix) {
+			continue
+		}
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(fileName, prefix), snapshot_file_suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshotFile{
+			path:     filepath.Join(p.dir, fileName),
+			sequence: sequence,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].sequence > snapshots[j].sequence
+	})
+	return snapshots, nil
+}
+
+func (p *FilePersistence) snapshotPath(sequence int64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s.%020d%s", p.name, sequence, snapshot_file_suffix))
+}
+
+type filePersistenceConfig struct {
+	Retention int
+	Compress  bool
+	Encoding  SnapshotEncoding
+}
+
+func newFilePersistenceConfig(options []filePersistenceOption) filePersistenceConfig {
+	conf := filePersistenceConfig{
+		Retention: default_snapshot_retention,
+		Compress:  false,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	if conf.Retention < 1 {
+		conf.Retention = 1
+	}
+	return conf
+}
+
+// WithSnapshotRetention sets the number of snapshots kept, 3 by default.
+func WithSnapshotRetention(retention int) filePersistenceOption {
+	return filePersistenceOptionFunc(func(conf filePersistenceConfig) filePersistenceConfig {
+		conf.Retention = retention
+		return conf
+	})
+}
+
+// WithSnapshotCompression gzip compresses the snapshots.
+func WithSnapshotCompression() filePersistenceOption {
+	return filePersistenceOptionFunc(func(conf filePersistenceConfig) filePersistenceConfig {
+		conf.Compress = true
+		return conf
+	})
+}
+
+// WithSnapshotEncoding sets the encoding of the snapshots, JSON by default.
+// The snapshots of every encoding are loaded.
+func WithSnapshotEncoding(encoding SnapshotEncoding) filePersistenceOption {
+	return filePersistenceOptionFunc(func(conf filePersistenceConfig) filePersistenceConfig {
+		conf.Encoding = encoding
+		return conf
+	})
+}
+
+type filePersistenceOption interface {
+	apply(filePersistenceConfig) filePersistenceConfig
+}
+
+type filePersistenceOptionFunc func(filePersistenceConfig) filePersistenceConfig
+
+func (o filePersistenceOptionFunc) apply(conf filePersistenceConfig) filePersistenceConfig {
+	return o(conf)
+}
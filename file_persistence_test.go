@@ -0,0 +1,121 @@
+package loggingdrain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMiner(t *testing.T, count int) *TemplateMiner {
+	miner, err := NewTemplateMiner(WithMaskInsturction(`\b\d+\b`, "NUM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, log := range testData[:count] {
+		miner.AddLogMessage(log)
+	}
+	return miner
+}
+
+func TestFilePersistence(t *testing.T) {
+	t.Run("test save and load", func(t *testing.T) {
+		p := NewFilePersistence(t.TempDir(), "miner")
+		miner := newTestMiner(t, 200)
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.Status(), loaded.Status())
+	})
+	t.Run("test compressed snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		p := NewFilePersistence(dir, "miner", WithSnapshotCompression())
+		miner := newTestMiner(t, 200)
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "miner.00000000000000000001.snapshot"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, strings.HasPrefix(string(b), "loggingdrain-snapshot 1 json gzip "))
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.Status(), loaded.Status())
+	})
+	t.Run("test rotation", func(t *testing.T) {
+		dir := t.TempDir()
+		p := NewFilePersistence(dir, "miner", WithSnapshotRetention(2))
+		for i := 1; i <= 4; i++ {
+			if err := p.Save(context.Background(), newTestMiner(t, i*10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, _ := os.ReadDir(dir)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{
+			"miner.00000000000000000003.snapshot",
+			"miner.00000000000000000004.snapshot",
+		}, names)
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, newTestMiner(t, 40).Status(), loaded.Status())
+	})
+	t.Run("test corrupted snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		p := NewFilePersistence(dir, "miner")
+		if err := p.Save(context.Background(), newTestMiner(t, 10)); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "miner.00000000000000000001.snapshot")
+		b, _ := os.ReadFile(path)
+		b[len(b)-2] ^= 0xff
+		os.WriteFile(path, b, 0o644)
+		_, err := p.Load(context.Background())
+		assert.True(t, errorIs(err, snapshotCorruptedError))
+
+		os.WriteFile(path, []byte("garbage"), 0o644)
+		_, err = p.Load(context.Background())
+		assert.True(t, errorIs(err, snapshotCorruptedError))
+	})
+	t.Run("test fall back to an older snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		p := NewFilePersistence(dir, "miner")
+		for i := 1; i <= 3; i++ {
+			if err := p.Save(context.Background(), newTestMiner(t, i*10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.WriteFile(filepath.Join(dir, "miner.00000000000000000003.snapshot"), []byte("garbage"), 0o644)
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, newTestMiner(t, 20).Status(), loaded.Status())
+
+		os.WriteFile(filepath.Join(dir, "miner.00000000000000000002.snapshot"), []byte("garbage"), 0o644)
+		os.WriteFile(filepath.Join(dir, "miner.00000000000000000001.snapshot"), []byte("garbage"), 0o644)
+		_, err = p.Load(context.Background())
+		assert.True(t, errorIs(err, snapshotCorruptedError))
+	})
+	t.Run("test missing snapshot", func(t *testing.T) {
+		p := NewFilePersistence(filepath.Join(t.TempDir(), "missing"), "miner")
+		_, err := p.Load(context.Background())
+		assert.NotNil(t, err)
+		assert.False(t, errorIs(err, snapshotCorruptedError))
+	})
+}
@@ -0,0 +1,81 @@
+package loggingdrain
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+)
+
+// fingerprint returns the FNV-64a hash of the template tokens in hex.
+func fingerprint(tokens []string) string {
+	h := fnv.New64a()
+	for i, token := range tokens {
+		if i > 0 {
+			h.Write([]byte{' '})
+		}
+		h.Write([]byte(token))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fingerprint returns a hash of the template of the cluster, which is the
+// same in every process mining the same logs with the same masking, unlike
+// the id. It changes when the template is generalized, the previous
+// fingerprints are kept in the lineage.
+func (cluster *LogCluster) Fingerprint() string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return fingerprint(cluster.logTemplateTokens)
+}
+
+// Lineage returns the previous fingerprints of the cluster, the oldest first:
+// those of its templates before they were generalized, and those of the
+// clusters merged into it.
+func (cluster *LogCluster) Lineage() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return append([]string{}, cluster.lineage...)
+}
+
+// hasFingerprint reports whether fp is the fingerprint of the cluster or one
+// of its lineage.
+func (cluster *LogCluster) hasFingerprint(fp string) bool {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	if fingerprint(cluster.logTemplateTokens) == fp {
+		return true
+	}
+	for _, previous := range cluster.lineage {
+		if previous == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// ClusterByFingerprint returns the cluster with the fingerprint fp, or the
+// cluster it was generalized or merged into. It returns nil when no cluster
+// of the miner has fp.
+func (miner *TemplateMiner) ClusterByFingerprint(fp string) *LogCluster {
+	return findFingerprint(miner.drain.clusters(), fp)
+}
+
+// ClusterByFingerprint returns the cluster of any shard with the fingerprint
+// fp, or the cluster it was generalized or merged into.
+func (miner *ShardedTemplateMiner) ClusterByFingerprint(fp string) *LogCluster {
+	return findFingerprint(miner.clusters(), fp)
+}
+
+// findFingerprint prefers a cluster with the current fingerprint fp to a
+// cluster with fp in its lineage.
+func findFingerprint(clusters []*LogCluster, fp string) *LogCluster {
+	var found *LogCluster
+	for _, cluster := range clusters {
+		if cluster.Fingerprint() == fp {
+			return cluster
+		}
+		if found == nil && cluster.hasFingerprint(fp) {
+			found = cluster
+		}
+	}
+	return found
+}
@@ -0,0 +1,75 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	t.Run("test fingerprint is stable", func(t *testing.T) {
+		assert.Equal(t, fingerprint([]string{"user", "[*]", "logged", "in"}), fingerprint(getStringTokens("user [*] logged in")))
+		assert.Len(t, fingerprint(nil), 16)
+
+		// the ids differ but the fingerprints match
+		first, _ := NewTemplateMiner()
+		second, _ := NewTemplateMiner()
+		second.AddLogMessage("disk is full")
+		for _, log := range []string{"user alice logged in", "user bob logged in"} {
+			a, b := first.AddLogMessage(log), second.AddLogMessage(log)
+			assert.Equal(t, a.Fingerprint, b.Fingerprint)
+			assert.Equal(t, a.Cluster.Fingerprint(), b.Cluster.Fingerprint())
+			assert.NotEqual(t, a.Cluster.ID(), b.Cluster.ID())
+		}
+	})
+	t.Run("test lineage", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		response := miner.AddLogMessage("user alice logged in")
+		original := response.Fingerprint
+		assert.Empty(t, response.PreviousFingerprint)
+
+		response = miner.AddLogMessage("user bob logged in")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, response.ChangeType)
+		assert.Equal(t, original, response.PreviousFingerprint)
+		assert.Equal(t, fingerprint(getStringTokens("user [*] logged in")), response.Fingerprint)
+		assert.Equal(t, []string{original}, response.Cluster.Lineage())
+
+		response = miner.AddLogMessage("user carol logged in")
+		assert.Empty(t, response.PreviousFingerprint)
+		assert.Same(t, response.Cluster, miner.ClusterByFingerprint(original))
+		assert.Same(t, response.Cluster, miner.ClusterByFingerprint(response.Fingerprint))
+		assert.Nil(t, miner.ClusterByFingerprint("0000000000000000"))
+	})
+	t.Run("test merged lineage", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		first := miner.AddLogMessage("user alice logged in")
+		second := miner.AddLogMessage("admin alice logged in")
+		merged, err := miner.MergeClusters(first.Cluster.ID(), second.Cluster.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.ElementsMatch(t, []string{first.Fingerprint, second.Fingerprint}, merged.Lineage())
+		assert.Same(t, merged, miner.ClusterByFingerprint(first.Fingerprint))
+		assert.Same(t, merged, miner.ClusterByFingerprint(second.Fingerprint))
+	})
+	t.Run("test lineage is persisted", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		lineage := miner.GetCluster(1).Lineage()
+		assert.NotEmpty(t, lineage)
+
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, lineage, loaded.GetCluster(1).Lineage())
+
+		data, _ := miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, lineage, loaded.GetCluster(1).Lineage())
+	})
+}
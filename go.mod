@@ -3,7 +3,6 @@ module github.com/palanqu/loggingdrain
 go 1.20
 
 require (
-	github.com/hashicorp/golang-lru/v2 v2.0.6
 	github.com/pkg/errors v0.9.1
 	github.com/redis/go-redis/v9 v9.2.1
 	github.com/stretchr/testify v1.8.3
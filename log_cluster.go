@@ -3,22 +3,67 @@ package loggingdrain
 import (
 	"encoding/json"
 	"strings"
+	"sync"
+	"time"
 )
 
+// LogCluster is safe to read from several goroutines while the miner is
+// updating it, the drain write lock is held as well when it is changed.
 type LogCluster struct {
+	mu                sync.RWMutex
 	id                int64
 	logTemplateTokens []string
+
+	// size is the number of log messages matched by the cluster, firstSeen
+	// and lastSeen are the times of the first and the latest of them.
+	size      int64
+	firstSeen time.Time
+	lastSeen  time.Time
+
+	// name is a human readable name set by an operator, pinned clusters
+	// are never evicted and the templates of locked clusters are never
+	// generalized.
+	name   string
+	pinned bool
+	locked bool
+
+	// lineage holds the previous fingerprints of the cluster, history the
+	// latest changes of its template.
+	lineage []string
+	history []TemplateChange
+
+	// leaves are the tree nodes holding the cluster, more than one once
+	// clusters are merged. They are guarded by the drain lock.
+	leaves []*treeNode
 }
 
 type logClusterMarshalStruct struct {
 	ID                int64
 	LogTemplateTokens []string
+	Size              int64
+	FirstSeen         time.Time
+	LastSeen          time.Time
+	Name              string           `json:",omitempty"`
+	Pinned            bool             `json:",omitempty"`
+	Locked            bool             `json:",omitempty"`
+	Lineage           []string         `json:",omitempty"`
+	History           []TemplateChange `json:",omitempty"`
 }
 
 func (cluster *LogCluster) MarshalJSON() ([]byte, error) {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
 	marshalStruct := logClusterMarshalStruct{
 		ID:                cluster.id,
 		LogTemplateTokens: cluster.logTemplateTokens,
+		Size:              cluster.size,
+		FirstSeen:         cluster.firstSeen,
+		LastSeen:          cluster.lastSeen,
+		Name:              cluster.name,
+		Pinned:            cluster.pinned,
+		Locked:            cluster.locked,
+		Lineage:           cluster.lineage,
+		History:           cluster.history,
 	}
 	return json.Marshal(&marshalStruct)
 }
@@ -31,6 +76,14 @@ func (cluster *LogCluster) UnmarshalJSON(data []byte) error {
 	}
 	cluster.id = marshalStruct.ID
 	cluster.logTemplateTokens = marshalStruct.LogTemplateTokens
+	cluster.size = marshalStruct.Size
+	cluster.firstSeen = marshalStruct.FirstSeen
+	cluster.lastSeen = marshalStruct.LastSeen
+	cluster.name = marshalStruct.Name
+	cluster.pinned = marshalStruct.Pinned
+	cluster.locked = marshalStruct.Locked
+	cluster.lineage = marshalStruct.Lineage
+	cluster.history = marshalStruct.History
 	return nil
 }
 
@@ -42,9 +95,104 @@ func newLogCluster(id int64, templateTokens []string) *LogCluster {
 }
 
 func (cluster *LogCluster) getTemplate() string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
 	return strings.Join(cluster.logTemplateTokens, " ")
 }
 
+// ID returns the id of the cluster.
+func (cluster *LogCluster) ID() int64 {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.id
+}
+
+// Template returns the template of the cluster, tokens joined by a space.
+func (cluster *LogCluster) Template() string {
+	return cluster.getTemplate()
+}
+
+// Tokens returns a copy of the template tokens of the cluster.
+func (cluster *LogCluster) Tokens() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	tokens := make([]string, len(cluster.logTemplateTokens))
+	copy(tokens, cluster.logTemplateTokens)
+	return tokens
+}
+
+// Size returns the number of log messages matched by the cluster.
+func (cluster *LogCluster) Size() int64 {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.size
+}
+
+// FirstSeen returns the time the cluster was created.
+func (cluster *LogCluster) FirstSeen() time.Time {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.firstSeen
+}
+
+// LastSeen returns the time of the latest log message matched by the
+// cluster.
+func (cluster *LogCluster) LastSeen() time.Time {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.lastSeen
+}
+
+// Name returns the name given to the cluster with SetClusterName.
+func (cluster *LogCluster) Name() string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.name
+}
+
+// Pinned reports whether the cluster is pinned, pinned clusters are never
+// evicted.
+func (cluster *LogCluster) Pinned() bool {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.pinned
+}
+
+// Locked reports whether the template of the cluster is locked, log
+// messages which do not fit it create new clusters.
+func (cluster *LogCluster) Locked() bool {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.locked
+}
+
+// seen counts a log message matched by the cluster at now, the cluster lock
+// must be held.
+func (cluster *LogCluster) seen(now time.Time) {
+	if cluster.size == 0 {
+		cluster.firstSeen = now
+	}
+	cluster.size += 1
+	cluster.lastSeen = now
+}
+
+func (cluster *LogCluster) clone() *LogCluster {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	tokens := make([]string, len(cluster.logTemplateTokens))
+	copy(tokens, cluster.logTemplateTokens)
+	c := newLogCluster(cluster.id, tokens)
+	c.size = cluster.size
+	c.firstSeen = cluster.firstSeen
+	c.lastSeen = cluster.lastSeen
+	c.name = cluster.name
+	c.pinned = cluster.pinned
+	c.locked = cluster.locked
+	c.lineage = append([]string(nil), cluster.lineage...)
+	c.history = append([]TemplateChange(nil), cluster.history...)
+	return c
+}
+
 type treeNodeType int
 
 const (
@@ -94,6 +242,16 @@ func (node *treeNode) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (node *treeNode) removeCluster(cluster *LogCluster) {
+	kept := make([]*LogCluster, 0, len(node.clusters))
+	for _, c := range node.clusters {
+		if c != cluster {
+			kept = append(kept, c)
+		}
+	}
+	node.clusters = kept
+}
+
 type treeNodes []*treeNode
 
 func (nodes treeNodes) push(node *treeNode) treeNodes {
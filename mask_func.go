@@ -0,0 +1,103 @@
+package loggingdrain
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Masker masks the values of a log message which a regexp cannot match well,
+// such as embedded json or quoted strings with escapes.
+type Masker interface {
+	// Mask returns content with the values replaced by placeholder.
+	Mask(content, placeholder string) string
+}
+
+// MaskerFunc is a Masker function.
+type MaskerFunc func(content, placeholder string) string
+
+func (f MaskerFunc) Mask(content, placeholder string) string {
+	return f(content, placeholder)
+}
+
+// TokenClassifier is a Masker replacing the whitespace separated tokens it
+// accepts, the whitespace is kept.
+type TokenClassifier func(token string) bool
+
+func (classify TokenClassifier) Mask(content, placeholder string) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		if token := content[start:end]; classify(token) {
+			b.WriteString(placeholder)
+		} else {
+			b.WriteString(token)
+		}
+		start = -1
+	}
+	for i, r := range content {
+		if unicode.IsSpace(r) {
+			flush(i)
+			b.WriteRune(r)
+		} else if start < 0 {
+			start = i
+		}
+	}
+	flush(len(content))
+	return b.String()
+}
+
+var (
+	maskersMu sync.RWMutex
+	maskers   = map[string]Masker{}
+)
+
+// RegisterMasker makes masker available to WithMaskerInstruction under name,
+// replacing the masker registered before with name. The snapshots record the
+// name only, so the process restoring a snapshot must register the same
+// maskers first.
+func RegisterMasker(name string, masker Masker) {
+	maskersMu.Lock()
+	defer maskersMu.Unlock()
+	maskers[name] = masker
+}
+
+func registeredMasker(name string) (Masker, bool) {
+	maskersMu.RLock()
+	defer maskersMu.RUnlock()
+	masker, ok := maskers[name]
+	return masker, ok
+}
+
+// WithMaskerInstruction adds a mask instruction replacing the values found by
+// the masker registered with name with the placeholder of maskWith, in the
+// priority order of WithPrioritizedMaskInstruction. An unregistered name is a
+// MaskPatternError. ExtractParameters matches the values of the masker like
+// wildcards.
+func WithMaskerInstruction(name, maskWith string, priority int) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Mask.MaskInstructions = append(conf.Mask.MaskInstructions, maskInstruction{
+			MaskWith: maskWith,
+			Priority: priority,
+			Masker:   name,
+		})
+		return conf
+	})
+}
+
+func newMaskerInstruction(maskWith, name string, priority int) (*logInstruction, error) {
+	masker, ok := registeredMasker(name)
+	if !ok {
+		return nil, errMaskPatternCompileRaw(fmt.Sprintf("unregistered masker %q", name))
+	}
+	return &logInstruction{
+		maskWith:   maskWith,
+		priority:   priority,
+		maskerName: name,
+		masker:     masker,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// maskJSON replaces the json objects embedded in content.
+func maskJSON(content, placeholder string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(content, '{')
+		if start < 0 {
+			b.WriteString(content)
+			return b.String()
+		}
+		decoder := json.NewDecoder(strings.NewReader(content[start:]))
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			b.WriteString(content[:start+1])
+			content = content[start+1:]
+			continue
+		}
+		b.WriteString(content[:start])
+		b.WriteString(placeholder)
+		content = content[start+int(decoder.InputOffset()):]
+	}
+}
+
+func TestMaskers(t *testing.T) {
+	RegisterMasker("test-json", MaskerFunc(maskJSON))
+	RegisterMasker("test-ip", TokenClassifier(func(token string) bool {
+		return net.ParseIP(token) != nil
+	}))
+
+	t.Run("test token classifier", func(t *testing.T) {
+		classifier := TokenClassifier(func(token string) bool { return token == "b" })
+		assert.Equal(t, "a  <> c\t<>\n", classifier.Mask("a  b c\tb\n", "<>"))
+		assert.Equal(t, "", classifier.Mask("", "<>"))
+	})
+	t.Run("test masker instructions", func(t *testing.T) {
+		miner, err := NewTemplateMiner(
+			WithMaskerInstruction("test-json", "JSON", 10),
+			WithMaskerInstruction("test-ip", "IP", 0),
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := `request {"user": "alice", "tags": ["a}"]} from 10.0.0.1 and 999.1.1.1 took 12`
+		assert.Equal(t, "request [:JSON:] from [:IP:] and [:NUM:].[:NUM:].[:NUM:].[:NUM:] took [:NUM:]",
+			miner.masker.mask(message))
+
+		params, err := miner.ExtractParameters(
+			"request [:JSON:] from [:IP:] and [:NUM:].[:NUM:].[:NUM:].[:NUM:] took [:NUM:]", message)
+		assert.Nil(t, err)
+		assert.Equal(t, ExtractedParameter{Value: `{"user": "alice", "tags": ["a}"]}`, Position: 1, MaskName: "JSON"}, params[0])
+		assert.Equal(t, ExtractedParameter{Value: "10.0.0.1", Position: 3, MaskName: "IP"}, params[1])
+	})
+	t.Run("test unregistered masker", func(t *testing.T) {
+		_, err := NewTemplateMiner(WithMaskerInstruction("test-missing", "X", 0))
+		assert.True(t, errorIs(err, maskPatternCompileError))
+	})
+	t.Run("test maskers are persisted by name", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(
+			WithMaskerInstruction("test-json", "JSON", 10),
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+		)
+		b, _ := json.Marshal(miner.masker)
+		assert.Contains(t, string(b), `"Masker":"test-json"`)
+
+		loaded := TemplateMiner{}
+		data, _ := json.Marshal(miner)
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		loadedJson, _ := json.Marshal(loaded.masker)
+		assert.Equal(t, b, loadedJson)
+		assert.Equal(t, "a [:JSON:] [:NUM:]", loaded.masker.mask(`a {"b": 1} 2`))
+
+		data, _ = miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		loadedJson, _ = json.Marshal(loaded.masker)
+		assert.Equal(t, b, loadedJson)
+	})
+}
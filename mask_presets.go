@@ -0,0 +1,156 @@
+package loggingdrain
+
+import (
+	"fmt"
+)
+
+// MaskPreset is the name of a built-in mask instruction.
+type MaskPreset string
+
+const (
+	// MASK_PRESET_URL masks urls with a scheme, as URL.
+	MASK_PRESET_URL MaskPreset = "url"
+	// MASK_PRESET_EMAIL masks email addresses, as EMAIL.
+	MASK_PRESET_EMAIL MaskPreset = "email"
+	// MASK_PRESET_UUID masks uuids, as UUID.
+	MASK_PRESET_UUID MaskPreset = "uuid"
+	// MASK_PRESET_IPV6 masks full and compressed ipv6 addresses, as IP.
+	MASK_PRESET_IPV6 MaskPreset = "ipv6"
+	// MASK_PRESET_TIMESTAMP masks ISO 8601, syslog and ctime timestamps and
+	// times of day, as TIMESTAMP.
+	MASK_PRESET_TIMESTAMP MaskPreset = "timestamp"
+	// MASK_PRESET_IPV4 masks ipv4 addresses, as IP.
+	MASK_PRESET_IPV4 MaskPreset = "ipv4"
+	// MASK_PRESET_PATH masks absolute or relative unix paths of two segments
+	// or more and windows paths, as PATH.
+	MASK_PRESET_PATH MaskPreset = "path"
+	// MASK_PRESET_DURATION masks durations such as 150ms or 1h30m, as
+	// DURATION.
+	MASK_PRESET_DURATION MaskPreset = "duration"
+	// MASK_PRESET_NUM masks integers and decimals, as NUM.
+	MASK_PRESET_NUM MaskPreset = "num"
+	// MASK_PRESET_HEX masks 0x prefixed hex numbers and hex ids of 8 digits
+	// or more, as HEX.
+	MASK_PRESET_HEX MaskPreset = "hex"
+
+	// MASK_PRESET_DEFAULT selects every preset.
+	MASK_PRESET_DEFAULT MaskPreset = "default"
+)
+
+type maskPreset struct {
+	pattern  string
+	maskWith string
+	priority int
+}
+
+const mask_preset_hex4 = `[0-9a-fA-F]{1,4}`
+
+// the priorities order the presets from the most specific to the least, a url
+// is masked before the path and the numbers in it.
+var maskPresets = map[MaskPreset]maskPreset{
+	MASK_PRESET_URL: {
+		pattern:  `\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>()\[\]]+`,
+		maskWith: "URL",
+		priority: 100,
+	},
+	MASK_PRESET_EMAIL: {
+		pattern:  `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`,
+		maskWith: "EMAIL",
+		priority: 90,
+	},
+	MASK_PRESET_UUID: {
+		pattern:  `\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`,
+		maskWith: "UUID",
+		priority: 80,
+	},
+	MASK_PRESET_IPV6: {
+		pattern: fmt.Sprintf(`\b(?:%[1]s:){7}%[1]s\b|\b%[1]s(?::%[1]s){0,6}::%[1]s(?::%[1]s){0,6}\b|::%[1]s(?::%[1]s){0,6}\b`,
+			mask_preset_hex4),
+		maskWith: "IP",
+		priority: 70,
+	},
+	MASK_PRESET_TIMESTAMP: {
+		pattern: `\b\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)?\b` +
+			`|\b(?:(?:Mon|Tue|Wed|Thu|Fri|Sat|Sun) )?(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec) +\d{1,2} \d{2}:\d{2}:\d{2}(?: \d{4})?\b` +
+			`|\b\d{2}:\d{2}:\d{2}(?:[.,]\d+)?\b`,
+		maskWith: "TIMESTAMP",
+		priority: 60,
+	},
+	MASK_PRESET_IPV4: {
+		pattern:  `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`,
+		maskWith: "IP",
+		priority: 50,
+	},
+	MASK_PRESET_PATH: {
+		pattern:  `(?:~|\.{1,2})?/[A-Za-z_.@-][\w.@-]*(?:/[\w.@-]+)+/?|\b[A-Za-z]:\\[^\s"'<>|,;]*`,
+		maskWith: "PATH",
+		priority: 40,
+	},
+	MASK_PRESET_DURATION: {
+		pattern:  `\b(?:\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h))+\b`,
+		maskWith: "DURATION",
+		priority: 30,
+	},
+	MASK_PRESET_NUM: {
+		pattern:  `\b\d+(?:\.\d+)?\b`,
+		maskWith: "NUM",
+		priority: 20,
+	},
+	// after NUM, the decimal ids are numbers
+	MASK_PRESET_HEX: {
+		pattern:  `\b0[xX][0-9a-fA-F]+\b|\b[0-9a-fA-F]{8,}\b`,
+		maskWith: "HEX",
+		priority: 10,
+	},
+}
+
+// defaultMaskPresets is the bundle of MASK_PRESET_DEFAULT.
+var defaultMaskPresets = []MaskPreset{
+	MASK_PRESET_URL,
+	MASK_PRESET_EMAIL,
+	MASK_PRESET_UUID,
+	MASK_PRESET_IPV6,
+	MASK_PRESET_TIMESTAMP,
+	MASK_PRESET_IPV4,
+	MASK_PRESET_PATH,
+	MASK_PRESET_DURATION,
+	MASK_PRESET_NUM,
+	MASK_PRESET_HEX,
+}
+
+// WithMaskPresets adds the mask instructions of the built-in presets, or of
+// all of them with MASK_PRESET_DEFAULT. The presets have priorities between
+// 10 and 100, so they apply before the instructions of priority 0. The
+// snapshots record the presets by name, an unknown name is a
+// MaskPatternError.
+func WithMaskPresets(presets ...MaskPreset) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		for _, preset := range presets {
+			names := []MaskPreset{preset}
+			if preset == MASK_PRESET_DEFAULT {
+				names = defaultMaskPresets
+			}
+			for _, name := range names {
+				conf.Mask.MaskInstructions = append(conf.Mask.MaskInstructions, maskInstruction{
+					Preset:   name,
+					Priority: maskPresets[name].priority,
+				})
+			}
+		}
+		return conf
+	})
+}
+
+// newPresetInstruction returns the instruction of preset with priority.
+func newPresetInstruction(preset MaskPreset, priority int) (*logInstruction, error) {
+	p, ok := maskPresets[preset]
+	if !ok {
+		return nil, errMaskPatternCompileRaw(fmt.Sprintf("unknown mask preset %q", preset))
+	}
+	ins, err := newLogInstruction(p.maskWith, p.pattern, priority)
+	if err != nil {
+		return nil, err
+	}
+	ins.preset = preset
+	return ins, nil
+}
@@ -0,0 +1,131 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskPresets(t *testing.T) {
+	testData := []struct {
+		preset   MaskPreset
+		input    string
+		expected string
+	}{
+		{
+			preset:   MASK_PRESET_URL,
+			input:    "fetch https://example.com/a/b?x=1 done",
+			expected: "fetch [:URL:] done",
+		},
+		{
+			preset:   MASK_PRESET_EMAIL,
+			input:    "(bhcompile@bugs.build.redhat.com) (gcc version 3.2.2)",
+			expected: "([:EMAIL:]) (gcc version 3.2.2)",
+		},
+		{
+			preset:   MASK_PRESET_UUID,
+			input:    "request 123e4567-e89b-12d3-a456-426614174000 failed",
+			expected: "request [:UUID:] failed",
+		},
+		{
+			preset:   MASK_PRESET_IPV6,
+			input:    "from fe80::1ff:fe23:4567:890a and ::1 and 2001:0db8:85a3:0000:0000:8a2e:0370:7334 at 15:16:01 std::string",
+			expected: "from [:IP:] and [:IP:] and [:IP:] at 15:16:01 std::string",
+		},
+		{
+			preset:   MASK_PRESET_TIMESTAMP,
+			input:    "Jun 24 18:55:11 combo ftpd[28568]: connection from 218.69.108.57 () at Fri Jun 24 18:55:11 2005",
+			expected: "[:TIMESTAMP:] combo ftpd[28568]: connection from 218.69.108.57 () at [:TIMESTAMP:]",
+		},
+		{
+			preset:   MASK_PRESET_TIMESTAMP,
+			input:    "Jul  2 04:15:43 combo at 2023-10-01T12:00:00.123Z or 2023-10-01 12:00:00+02:00 or 08:10:30",
+			expected: "[:TIMESTAMP:] combo at [:TIMESTAMP:] or [:TIMESTAMP:] or [:TIMESTAMP:]",
+		},
+		{
+			preset:   MASK_PRESET_IPV4,
+			input:    "authentication failure; logname= uid=0 euid=0 tty=NODEVssh ruser= rhost=218.188.2.4 version 1.2.3",
+			expected: "authentication failure; logname= uid=0 euid=0 tty=NODEVssh ruser= rhost=[:IP:] version 1.2.3",
+		},
+		{
+			preset:   MASK_PRESET_PATH,
+			input:    "removing device node '/udev/vcsa2' and ./conf/app.yml, C:\\logs\\app.log, not PS/2 or 4G/4G",
+			expected: "removing device node '[:PATH:]' and [:PATH:], [:PATH:], not PS/2 or 4G/4G",
+		},
+		{
+			preset:   MASK_PRESET_DURATION,
+			input:    "took 150ms then 1h30m5s, 4G free",
+			expected: "took [:DURATION:] then [:DURATION:], 4G free",
+		},
+		{
+			preset:   MASK_PRESET_NUM,
+			input:    "combo sshd(pam_unix)[19939]: uid=0 load 0.75 dsl-082-083",
+			expected: "combo sshd(pam_unix)[[:NUM:]]: uid=[:NUM:] load [:NUM:] dsl-[:NUM:]-[:NUM:]",
+		},
+		{
+			preset:   MASK_PRESET_HEX,
+			input:    "BIOS-e820: 0x03 at 0xfc0ce, id c51471f2c, word added",
+			expected: "BIOS-e820: [:HEX:] at [:HEX:], id [:HEX:], word added",
+		},
+	}
+	for _, data := range testData {
+		t.Run(fmt.Sprintf("preset %s masks %s", data.preset, data.input), func(t *testing.T) {
+			miner, err := NewTemplateMiner(WithMaskPresets(data.preset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, data.expected, miner.masker.mask(data.input))
+		})
+	}
+
+	t.Run("test default presets", func(t *testing.T) {
+		miner, err := NewTemplateMiner(WithMaskPresets(MASK_PRESET_DEFAULT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, miner.masker.instructions, len(defaultMaskPresets))
+		assert.Equal(t,
+			"[:TIMESTAMP:] combo ftpd[[:NUM:]]: connection from [:IP:] ([:NUM:]) at [:TIMESTAMP:]",
+			miner.masker.mask("Jul 25 06:39:18 combo ftpd[24964]: connection from 206.47.209.10 (10) at Mon Jul 25 06:39:18 2005"))
+		assert.Equal(t,
+			"GET [:URL:] from [:IP:] in [:DURATION:]",
+			miner.masker.mask("GET http://10.0.0.1:8080/api/v1 from 2001:db8::ff00:42 in 12.5ms"))
+
+		for _, log := range readTestData() {
+			masked := miner.masker.mask(log)
+			assert.NotRegexp(t, `rhost=\d`, masked)
+			assert.False(t, strings.HasPrefix(masked, "Jun ") || strings.HasPrefix(masked, "Jul "), masked)
+		}
+	})
+	t.Run("test unknown preset", func(t *testing.T) {
+		_, err := NewTemplateMiner(WithMaskPresets("phone"))
+		assert.True(t, errorIs(err, maskPatternCompileError))
+	})
+	t.Run("test presets are persisted by name", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(
+			WithMaskPresets(MASK_PRESET_DEFAULT),
+			WithMaskInsturction(`\bcombo\b`, "HOST"),
+		)
+		miner.AddLogMessage("Jun 14 15:16:01 combo sshd(pam_unix)[19939]: check pass; user unknown")
+		b, _ := json.Marshal(miner)
+		assert.Contains(t, string(b), `"Preset":"timestamp"`)
+		assert.NotContains(t, string(b), maskPresets[MASK_PRESET_TIMESTAMP].pattern)
+
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.masker, loaded.masker)
+
+		data, _ := miner.MarshalBinary()
+		assert.NotContains(t, string(data), maskPresets[MASK_PRESET_TIMESTAMP].pattern)
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.masker, loaded.masker)
+	})
+}
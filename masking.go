@@ -3,6 +3,8 @@ package loggingdrain
 import (
 	"encoding/json"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 const (
@@ -10,16 +12,24 @@ const (
 	default_masking_suffix = ":]"
 )
 
+// logMasker applies its instructions one after the other, in the order of
+// their priority, the highest first, then in the order they were added.
 type logMasker struct {
-	prefix             string
-	suffix             string
-	nameToInstructions map[string]*logInstruction
+	prefix       string
+	suffix       string
+	instructions []*logInstruction
 }
 
 type logInstruction struct {
 	pattern  string
 	maskWith string
-	re       *regexp.Regexp
+	priority int
+	// preset is the name of the built-in instruction, if any.
+	preset MaskPreset
+	re     *regexp.Regexp
+	// maskerName is the registered name of masker, which replaces re.
+	maskerName string
+	masker     Masker
 }
 
 type logMaskerMarshalStruct struct {
@@ -28,17 +38,31 @@ type logMaskerMarshalStruct struct {
 	MaskInstructions []*logInstruction
 }
 
+// logInstructionMarshalStruct holds the preset name instead of the pattern of
+// the preset instructions, and the masker name of the masker instructions.
 type logInstructionMarshalStruct struct {
-	Pattern  string
-	MaskWith string
+	Pattern  string     `json:",omitempty"`
+	MaskWith string     `json:",omitempty"`
+	Priority int        `json:",omitempty"`
+	Preset   MaskPreset `json:",omitempty"`
+	Masker   string     `json:",omitempty"`
 }
 
 func (logInstruction *logInstruction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(logInstruction.marshalStruct())
+}
+
+func (logInstruction *logInstruction) marshalStruct() logInstructionMarshalStruct {
 	marshalStruct := logInstructionMarshalStruct{
-		Pattern:  logInstruction.pattern,
-		MaskWith: logInstruction.maskWith,
+		Priority: logInstruction.priority,
+		Preset:   logInstruction.preset,
+		Masker:   logInstruction.maskerName,
 	}
-	return json.Marshal(marshalStruct)
+	if logInstruction.preset == "" {
+		marshalStruct.Pattern = logInstruction.pattern
+		marshalStruct.MaskWith = logInstruction.maskWith
+	}
+	return marshalStruct
 }
 
 func (logInstruction *logInstruction) UnmarshalJSON(data []byte) error {
@@ -47,24 +71,29 @@ func (logInstruction *logInstruction) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	re, err := regexp.Compile(marshalStruct.Pattern)
+	ins, err := newConfigInstruction(maskInstruction{
+		Pattern:  marshalStruct.Pattern,
+		MaskWith: marshalStruct.MaskWith,
+		Priority: marshalStruct.Priority,
+		Preset:   marshalStruct.Preset,
+		Masker:   marshalStruct.Masker,
+	})
 	if err != nil {
-		return errMaskPatternCompile(err)
+		return err
 	}
-	logInstruction.pattern = marshalStruct.Pattern
-	logInstruction.maskWith = marshalStruct.MaskWith
-	logInstruction.re = re
+	*logInstruction = *ins
 	return nil
 }
 
+// MarshalJSON encodes the instructions in the order they are applied.
 func (logMasker *logMasker) MarshalJSON() ([]byte, error) {
 	marshalStruct := logMaskerMarshalStruct{
 		Prefix:           logMasker.prefix,
 		Suffix:           logMasker.suffix,
-		MaskInstructions: make([]*logInstruction, 0, len(logMasker.nameToInstructions)),
+		MaskInstructions: logMasker.instructions,
 	}
-	for _, v := range logMasker.nameToInstructions {
-		marshalStruct.MaskInstructions = append(marshalStruct.MaskInstructions, v)
+	if marshalStruct.MaskInstructions == nil {
+		marshalStruct.MaskInstructions = []*logInstruction{}
 	}
 	return json.Marshal(marshalStruct)
 }
@@ -77,14 +106,17 @@ func (logMasker *logMasker) UnmarshalJSON(data []byte) error {
 	}
 	logMasker.prefix = marshalStruct.Prefix
 	logMasker.suffix = marshalStruct.Suffix
-	logMasker.nameToInstructions = map[string]*logInstruction{}
+	logMasker.instructions = []*logInstruction{}
 	for _, v := range marshalStruct.MaskInstructions {
-		logMasker.nameToInstructions[v.maskWith] = v
+		if v == nil {
+			return errSnapshotCorruptedRaw("snapshot with a null mask instruction")
+		}
+		logMasker.insert(v)
 	}
 	return nil
 }
 
-func newLogInstruction(maskWith, pattern string) (*logInstruction, error) {
+func newLogInstruction(maskWith, pattern string, priority int) (*logInstruction, error) {
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return nil, errMaskPatternCompile(err)
@@ -92,71 +124,115 @@ func newLogInstruction(maskWith, pattern string) (*logInstruction, error) {
 	return &logInstruction{
 		pattern:  pattern,
 		maskWith: maskWith,
+		priority: priority,
 		re:       re,
 	}, nil
 }
 
+// newConfigInstruction returns the preset, masker or regexp instruction of
+// conf.
+func newConfigInstruction(conf maskInstruction) (*logInstruction, error) {
+	switch {
+	case conf.Preset != "":
+		return newPresetInstruction(conf.Preset, conf.Priority)
+	case conf.Masker != "":
+		return newMaskerInstruction(conf.MaskWith, conf.Masker, conf.Priority)
+	}
+	return newLogInstruction(conf.MaskWith, conf.Pattern, conf.Priority)
+}
+
 func (ins *logInstruction) mask(content, prefix, suffix string) string {
 	maskStr := prefix + ins.maskWith + suffix
+	if ins.masker != nil {
+		return ins.masker.Mask(content, maskStr)
+	}
 	return ins.re.ReplaceAllString(content, maskStr)
 }
 
 func newLogMaskerWithConfig(maskConfig maskConfig) (*logMasker, error) {
-	nameToInstructions := map[string]*logInstruction{}
-	for _, ins := range maskConfig.MaskInstructions {
-		newIns, err := newLogInstruction(ins.MaskWith, ins.Pattern)
+	masker, err := newLogMasker(maskConfig.Prefix, maskConfig.Suffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, conf := range maskConfig.MaskInstructions {
+		ins, err := newConfigInstruction(conf)
 		if err != nil {
 			return nil, err
 		}
-		nameToInstructions[ins.MaskWith] = newIns
-	}
-
-	masker := &logMasker{
-		prefix:             maskConfig.Prefix,
-		suffix:             maskConfig.Suffix,
-		nameToInstructions: nameToInstructions,
+		masker.insert(ins)
 	}
 	return masker, nil
 }
 
 func newLogMasker(prefix, suffix string) (*logMasker, error) {
-	nameToInstructions := map[string]*logInstruction{}
 	masker := &logMasker{
-		prefix:             prefix,
-		suffix:             suffix,
-		nameToInstructions: nameToInstructions,
+		prefix:       prefix,
+		suffix:       suffix,
+		instructions: []*logInstruction{},
 	}
 	return masker, nil
 }
 
-func (mask *logMasker) addInstruction(maskWith, pattern string) error {
-	ins, err := newLogInstruction(maskWith, pattern)
+// addInstruction adds an instruction after those of the same or a higher
+// priority, several instructions may share maskWith.
+func (mask *logMasker) addInstruction(maskWith, pattern string, priority int) error {
+	ins, err := newLogInstruction(maskWith, pattern, priority)
 	if err != nil {
 		return err
 	}
-	mask.nameToInstructions[maskWith] = ins
+	mask.insert(ins)
 	return nil
 }
 
+func (mask *logMasker) insert(ins *logInstruction) {
+	i := sort.Search(len(mask.instructions), func(i int) bool {
+		return mask.instructions[i].priority < ins.priority
+	})
+	mask.instructions = append(mask.instructions, nil)
+	copy(mask.instructions[i+1:], mask.instructions[i:])
+	mask.instructions[i] = ins
+}
+
 func (mask *logMasker) mask(content string) string {
-	if len(mask.nameToInstructions) == 0 {
-		return content
-	}
 	res := content
-	for _, v := range mask.nameToInstructions {
-		res = v.mask(res, mask.prefix, mask.suffix)
+	for _, ins := range mask.instructions {
+		res = ins.mask(res, mask.prefix, mask.suffix)
 	}
 	return res
 }
 
+// maskNames returns the distinct mask names.
 func (mask *logMasker) maskNames() []string {
-	names := make([]string, 0, len(mask.nameToInstructions))
-	for k := range mask.nameToInstructions {
-		names = append(names, k)
+	names := []string{}
+	seen := map[string]bool{}
+	for _, ins := range mask.instructions {
+		if !seen[ins.maskWith] {
+			seen[ins.maskWith] = true
+			names = append(names, ins.maskWith)
+		}
 	}
 	return names
 }
 
-func (mask *logMasker) instruction(name string) *logInstruction {
-	return mask.nameToInstructions[name]
+// namePattern returns a pattern matching any of the patterns of the mask
+// name, and its number of capture groups. The values of a masker are matched
+// like wildcards.
+func (mask *logMasker) namePattern(name string) (string, int) {
+	patterns := []string{}
+	groups := 0
+	for _, ins := range mask.instructions {
+		if ins.maskWith != name {
+			continue
+		}
+		if ins.masker != nil {
+			patterns = append(patterns, `.+?`)
+			continue
+		}
+		patterns = append(patterns, unanchoredPattern(ins.pattern))
+		groups += ins.re.NumSubexp()
+	}
+	if len(patterns) == 1 {
+		return patterns[0], groups
+	}
+	return "(?:" + strings.Join(patterns, "|") + ")", groups
 }
@@ -1,6 +1,7 @@
 package loggingdrain
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,7 +12,7 @@ func TestMasking(t *testing.T) {
 		beforeMaskStr := "D9 test 999, 888 1A ccc 3"
 		expectMaskedStr := "D9 test <!NUM!>, <!NUM!> 1A ccc <!NUM!>"
 		logMasker, _ := newLogMasker("<!", "!>")
-		if err := logMasker.addInstruction("NUM", `\b\d+\b`); err != nil {
+		if err := logMasker.addInstruction("NUM", `\b\d+\b`, 0); err != nil {
 			t.Fatalf("add instruction error %s", err)
 		}
 		res := logMasker.mask(beforeMaskStr)
@@ -21,10 +22,48 @@ func TestMasking(t *testing.T) {
 		beforeMaskStr := "the income ip is 127.0.0.1, abc, 10.3.24.13, 456"
 		expectMaskedStr := "the income ip is <!IP!>, abc, <!IP!>, 456"
 		logMasker, _ := newLogMasker("<!", "!>")
-		if err := logMasker.addInstruction("IP", `\b(?:\d{1,3}\.){3}\d{1,3}\b`); err != nil {
+		if err := logMasker.addInstruction("IP", `\b(?:\d{1,3}\.){3}\d{1,3}\b`, 0); err != nil {
 			t.Fatalf("add instruction error %s", err)
 		}
 		res := logMasker.mask(beforeMaskStr)
 		assert.Equal(t, expectMaskedStr, res)
 	})
+	t.Run("test masking order", func(t *testing.T) {
+		logMasker, _ := newLogMasker("<!", "!>")
+		_ = logMasker.addInstruction("NUM", `\b\d+\b`, 0)
+		_ = logMasker.addInstruction("IP", `\b(?:\d{1,3}\.){3}\d{1,3}\b`, 10)
+		_ = logMasker.addInstruction("HEX", `\b0x[0-9a-f]+\b`, 0)
+		assert.Equal(t, []string{"IP", "NUM", "HEX"}, logMasker.maskNames())
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "ip <!IP!> port <!NUM!>", logMasker.mask("ip 10.0.0.1 port 80"))
+		}
+	})
+	t.Run("test shared mask names", func(t *testing.T) {
+		miner, err := NewTemplateMiner(
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+			WithMaskInsturction(`\b0x[0-9a-f]+\b`, "NUM"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "read [:NUM:] bytes at [:NUM:]", miner.masker.mask("read 16 bytes at 0xff"))
+		params, err := miner.ExtractParameters("read [:NUM:] bytes at [:NUM:]", "read 16 bytes at 0xff")
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "16", Position: 1, MaskName: "NUM"},
+			{Value: "0xff", Position: 4, MaskName: "NUM"},
+		}, params)
+	})
+	t.Run("test masking order is persisted", func(t *testing.T) {
+		masker, _ := newLogMasker("<!", "!>")
+		_ = masker.addInstruction("NUM", `\b\d+\b`, 0)
+		_ = masker.addInstruction("IP", `\b(?:\d{1,3}\.){3}\d{1,3}\b`, 10)
+		_ = masker.addInstruction("ID", `\b[a-f0-9]{8}\b`, 0)
+		b, _ := json.Marshal(masker)
+		loaded := &logMasker{}
+		if err := json.Unmarshal(b, loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, masker, loaded)
+	})
 }
@@ -1,30 +1,54 @@
 package loggingdrain
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
 
+// TemplateMiner is safe for concurrent use, matches run in parallel while
+// added log messages are applied to the tree one at a time.
 type TemplateMiner struct {
 	drain  *drain
 	masker *logMasker
+
+	listeners changeListeners
 }
 
 type templateMinerMarshalStruct struct {
+	snapshotEnvelope
 	Drain  *drain
 	Masker *logMasker
 }
 
 func (miner *TemplateMiner) MarshalJSON() ([]byte, error) {
+	envelope, err := newSnapshotEnvelope(miner.drain.now(), miner.masker, miner.drain)
+	if err != nil {
+		return nil, err
+	}
 	return json.Marshal(templateMinerMarshalStruct{
-		Drain:  miner.drain,
-		Masker: miner.masker,
+		snapshotEnvelope: envelope,
+		Drain:            miner.drain,
+		Masker:           miner.masker,
 	})
 }
 
+// UnmarshalJSON upgrades the snapshots of older format versions, a
+// SnapshotVersionError is returned for the snapshots of a newer version.
 func (miner *TemplateMiner) UnmarshalJSON(data []byte) error {
+	data, migrated, err := migrateSnapshot(data)
+	if err != nil {
+		return err
+	}
 	var marshalStruct templateMinerMarshalStruct
-	err := json.Unmarshal(data, &marshalStruct)
+	err = json.Unmarshal(data, &marshalStruct)
 	if err != nil {
 		return err
 	}
+	if err := marshalStruct.check(migrated, marshalStruct.Masker, marshalStruct.Drain); err != nil {
+		return err
+	}
 	miner.drain = marshalStruct.Drain
 	miner.masker = marshalStruct.Masker
 	return nil
@@ -35,6 +59,40 @@ type LogMessageResponse struct {
 	Cluster       *LogCluster
 	TemplateMined string
 	ClusterCount  int
+
+	// Fingerprint is the fingerprint of the template mined, and
+	// PreviousFingerprint the one of the template it generalized when
+	// ChangeType is CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, as PreviousTemplate.
+	Fingerprint         string
+	PreviousFingerprint string
+	PreviousTemplate    string
+
+	// ClusterSize, FirstSeen and LastSeen are the statistics of Cluster
+	// right after the log message was added.
+	ClusterSize int64
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// newLogMessageResponse returns the response for cluster, previous are the
+// template tokens it generalized. The cluster lock must be held.
+func newLogMessageResponse(cluster *LogCluster, updateType ClusterUpdateType, previous []string) *LogMessageResponse {
+	previousFingerprint, previousTemplate := "", ""
+	if previous != nil {
+		previousFingerprint = fingerprint(previous)
+		previousTemplate = strings.Join(previous, " ")
+	}
+	return &LogMessageResponse{
+		ChangeType:          updateType,
+		Cluster:             cluster,
+		TemplateMined:       strings.Join(cluster.logTemplateTokens, " "),
+		Fingerprint:         fingerprint(cluster.logTemplateTokens),
+		PreviousFingerprint: previousFingerprint,
+		PreviousTemplate:    previousTemplate,
+		ClusterSize:         cluster.size,
+		FirstSeen:           cluster.firstSeen,
+		LastSeen:            cluster.lastSeen,
+	}
 }
 
 func NewTemplateMiner(options ...minerOption) (*TemplateMiner, error) {
@@ -43,15 +101,44 @@ func NewTemplateMiner(options ...minerOption) (*TemplateMiner, error) {
 }
 
 func newTemplateMinerWithConfig(config *minerConfig) (*TemplateMiner, error) {
+	if config.Persistence != nil {
+		miner, err := config.Persistence.Load(context.Background())
+		if err == nil {
+			miner.applyRuntimeConfig(config)
+			if err := miner.SeedTemplates(config.Seeds...); err != nil {
+				return nil, err
+			}
+			return miner, nil
+		}
+		if !errorIs(err, snapshotNotFoundError) {
+			return nil, err
+		}
+	}
+	tokenizer, err := config.Drain.Tokenizer.resolve()
+	if err != nil {
+		return nil, err
+	}
+	config.Drain.Tokenizer = tokenizer
 	drain := newDrainWithConfig(config.Drain)
 	masker, err := newLogMaskerWithConfig(config.Mask)
 	if err != nil {
 		return nil, err
 	}
-	return &TemplateMiner{
+	miner := &TemplateMiner{
 		drain:  drain,
 		masker: masker,
-	}, nil
+	}
+	if err := miner.SeedTemplates(config.Seeds...); err != nil {
+		return nil, err
+	}
+	return miner, nil
+}
+
+// applyRuntimeConfig applies the part of config which is not persisted to
+// a restored miner.
+func (miner *TemplateMiner) applyRuntimeConfig(config *minerConfig) {
+	miner.drain.clock = config.Drain.Clock
+	miner.drain.onEvict = config.Drain.OnEvict
 }
 
 func newTemplateMinerConfig(options []minerOption) *minerConfig {
@@ -78,13 +165,10 @@ func newTemplateMinerConfig(options []minerOption) *minerConfig {
 
 func (miner *TemplateMiner) AddLogMessage(message string) *LogMessageResponse {
 	maskedMessage := miner.masker.mask(message)
-	logCluster, updateType := miner.drain.addLogMessage(maskedMessage)
-	return &LogMessageResponse{
-		ChangeType:    updateType,
-		Cluster:       logCluster,
-		TemplateMined: logCluster.getTemplate(),
-		ClusterCount:  len(miner.drain.idToCluster.Keys()),
-	}
+	response := miner.drain.addLogMessage(maskedMessage)
+	miner.listeners.notify(response.ChangeType, response.Cluster)
+	response.ClusterCount = miner.drain.clusterCount()
+	return response
 }
 
 func (miner *TemplateMiner) Match(message string) *LogCluster {
@@ -92,6 +176,32 @@ func (miner *TemplateMiner) Match(message string) *LogCluster {
 	return miner.drain.match(maskedMessage, SEARCH_STRATEGY_NEVER)
 }
 
+type MatchResult struct {
+	Cluster *LogCluster
+	// Similarity is the share of the template tokens equal to the tokens of
+	// the message, wildcards included.
+	Similarity float32
+	// ParamCount is the number of wildcards in the template.
+	ParamCount int64
+}
+
+// MatchWithStrategy matches message like Match, searching the clusters with
+// strategy. The match shall be perfect unless WithMatchSimilarity lowers the
+// required similarity. It returns nil when no cluster matches.
+func (miner *TemplateMiner) MatchWithStrategy(message string, strategy SearchStrategy, options ...matchOption) *MatchResult {
+	conf := newMatchConfig(options)
+	maskedMessage := miner.masker.mask(message)
+	cluster, sim, paramCount := miner.drain.matchTokens(miner.drain.tokenize(maskedMessage), strategy, conf.Similarity)
+	if cluster == nil {
+		return nil
+	}
+	return &MatchResult{
+		Cluster:    cluster,
+		Similarity: sim,
+		ParamCount: paramCount,
+	}
+}
+
 func WithDrainDepth(depth int) minerOption {
 	return minerOptionFunc(func(conf minerConfig) minerConfig {
 		conf.Drain.Depth = depth
@@ -120,6 +230,66 @@ func WithDrainMaxCluster(maxCluster int) minerOption {
 	})
 }
 
+// WithClock sets the clock used for the first and last seen times of the
+// clusters, time.Now by default.
+func WithClock(clock func() time.Time) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain.Clock = clock
+		return conf
+	})
+}
+
+// WithClusterIDSpace makes the miner assign the cluster ids offset+1,
+// offset+1+stride, offset+1+2*stride, ... Replicas synchronized with
+// TemplateSync shall share the stride and use distinct offsets, so that
+// clusters learned independently never get the same id.
+func WithClusterIDSpace(offset, stride int64) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain = withClusterIDSpace(offset, stride).apply(conf.Drain)
+		return conf
+	})
+}
+
+// WithEvictionPolicy sets the policy choosing the cluster evicted when the
+// miner holds more than the max cluster count, EVICTION_POLICY_LRU by
+// default. Pinned clusters are never evicted whatever the policy.
+func WithEvictionPolicy(policy EvictionPolicy) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain = withEvictionPolicy(policy).apply(conf.Drain)
+		return conf
+	})
+}
+
+// WithEvictionCallback calls onEvict with every evicted cluster, its
+// template and statistics are those at the time of the eviction. onEvict is
+// called after the miner is unlocked, from the goroutine adding the log
+// message which caused the eviction.
+func WithEvictionCallback(onEvict func(cluster *LogCluster)) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain = withEvictionCallback(onEvict).apply(conf.Drain)
+		return conf
+	})
+}
+
+// WithTemplateHistorySize sets the number of template changes kept per
+// cluster, 10 by default.
+func WithTemplateHistorySize(size int) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain = withHistorySize(size).apply(conf.Drain)
+		return conf
+	})
+}
+
+// WithPersistence restores the miner from the latest snapshot of handler.
+// The snapshot takes precedence over the drain and mask options, a new miner
+// is created from the options when handler has no snapshot yet.
+func WithPersistence(handler PersistenceHandler) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Persistence = handler
+		return conf
+	})
+}
+
 func WithMaskPrefix(prefix string) minerOption {
 	return minerOptionFunc(func(conf minerConfig) minerConfig {
 		conf.Mask.Prefix = prefix
@@ -134,11 +304,24 @@ func WithMaskSuffix(suffix string) minerOption {
 	})
 }
 
+// WithMaskInsturction adds a mask instruction of priority 0, see
+// WithPrioritizedMaskInstruction.
 func WithMaskInsturction(pattern, maskWith string) minerOption {
+	return WithPrioritizedMaskInstruction(pattern, maskWith, 0)
+}
+
+// WithPrioritizedMaskInstruction adds a mask instruction replacing the
+// matches of pattern with the placeholder of maskWith. The instructions are
+// applied one after the other, those of the highest priority first and the
+// instructions of equal priority in the order they were added, so that an IP
+// mask of a higher priority applies before a NUM mask matching its parts.
+// Several instructions may share maskWith.
+func WithPrioritizedMaskInstruction(pattern, maskWith string, priority int) minerOption {
 	return minerOptionFunc(func(conf minerConfig) minerConfig {
 		conf.Mask.MaskInstructions = append(conf.Mask.MaskInstructions, maskInstruction{
 			Pattern:  pattern,
 			MaskWith: maskWith,
+			Priority: priority,
 		})
 		return conf
 	})
@@ -148,6 +331,38 @@ func (miner *TemplateMiner) Status() string {
 	return miner.drain.status()
 }
 
+type matchConfig struct {
+	Similarity float32
+}
+
+func newMatchConfig(options []matchOption) matchConfig {
+	conf := matchConfig{
+		Similarity: 1,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	return conf
+}
+
+// WithMatchSimilarity sets the minimum similarity of a match, 1 by default.
+func WithMatchSimilarity(sim float32) matchOption {
+	return matchOptionFunc(func(conf matchConfig) matchConfig {
+		conf.Similarity = sim
+		return conf
+	})
+}
+
+type matchOption interface {
+	apply(matchConfig) matchConfig
+}
+
+type matchOptionFunc func(matchConfig) matchConfig
+
+func (o matchOptionFunc) apply(conf matchConfig) matchConfig {
+	return o(conf)
+}
+
 type minerOption interface {
 	apply(minerConfig) minerConfig
 }
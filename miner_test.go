@@ -2,9 +2,13 @@ package loggingdrain
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -53,22 +57,36 @@ func BenchmarkUnmarshalJson(b *testing.B) {
 	}
 }
 
+// testMinerJsonV1 is the snapshot of testMinerLogs written by the first
+// release, before the snapshots were versioned.
+const testMinerJsonV1 = `{"Drain":{"MaxDepth":4,"Sim":0.4,"MaxChildren":100,"MaxClusters":1000,"ClusterCounter":2,"Clusters":[{"ID":1,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","input_userauth_request:","invalid","user","[*]","[preauth]"]},{"ID":2,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","Failed","password","for","invalid","user","[*]","from","0.0.0.0","port","[*]","ssh2"]}],"RootNode":{"NodeType":0,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren": {"10":{"NodeType":1,"Length":10,"TokenNodeChildren":{"Dec":{"NodeType":2,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren":{},"Clusters":[{"ID":1, "LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","input_userauth_request:","invalid","user","[*]","[preauth]"]}]}},"LengthNodeChildren":{},"Clusters":[]},"16":{"NodeType":1,"Length":16,"TokenNodeChildren":{"Dec":{"NodeType":2,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren":{},"Clusters":[{"ID":2,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","Failed","password","for","invalid","user","[*]","from","0.0.0.0","port","[*]","ssh2"]}]}},"LengthNodeChildren":{},"Clusters":[]}},"Clusters":[]}},"Masker":{"Prefix":"[:","Suffix":":]","MaskInstructions":[{"Pattern":"abc","MaskWith":"abc"}]}}`
+
+// testMinerJson is the snapshot of testMinerLogs.
+const testMinerJson = `{"FormatVersion":3,"LibraryVersion":"0.2.0","CreatedAt":"2023-10-01T00:00:00Z","ConfigHash":"879ac636c69a9219","Drain":{"MaxDepth":4,"Sim":0.4,"MaxChildren":100,"MaxClusters":1000,"ClusterCounter":2,"Clusters":[{"ID":1,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","input_userauth_request:","invalid","user","[*]","[preauth]"],"Size":3,"FirstSeen":"2023-10-01T00:00:00Z","LastSeen":"2023-10-01T00:00:00Z","Lineage":["4cb87b6d6e186155"],"History":[{"PreviousTemplate":"Dec 10 07:07:38 LabSZ sshd[24206]: input_userauth_request: invalid user test9 [preauth]","Template":"Dec 10 [*] LabSZ [*] input_userauth_request: invalid user [*] [preauth]","Message":"Dec 10 07:08:28 LabSZ sshd[24208]: input_userauth_request: invalid user webmaster [preauth]","Wildcards":[2,4,8],"Time":"2023-10-01T00:00:00Z"}]},{"ID":2,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","Failed","password","for","invalid","user","[*]","from","0.0.0.0","port","[*]","ssh2"],"Size":3,"FirstSeen":"2023-10-01T00:00:00Z","LastSeen":"2023-10-01T00:00:00Z","Lineage":["0be9a0bd835052e3"],"History":[{"PreviousTemplate":"Dec 10 09:12:32 LabSZ sshd[24490]: Failed password for invalid user ftpuser from 0.0.0.0 port 62891 ssh2","Template":"Dec 10 [*] LabSZ [*] Failed password for invalid user [*] from 0.0.0.0 port [*] ssh2","Message":"Dec 10 09:12:35 LabSZ sshd[24492]: Failed password for invalid user pi from 0.0.0.0 port 49289 ssh2","Wildcards":[2,4,10,14],"Time":"2023-10-01T00:00:00Z"}]}]},"Masker":{"Prefix":"[:","Suffix":":]","MaskInstructions":[{"Pattern":"abc","MaskWith":"abc"}]}}`
+
+var testMinerLogs = []string{
+	"Dec 10 07:07:38 LabSZ sshd[24206]: input_userauth_request: invalid user test9 [preauth]",
+	"Dec 10 07:08:28 LabSZ sshd[24208]: input_userauth_request: invalid user webmaster [preauth]",
+	"Dec 10 09:12:32 LabSZ sshd[24490]: Failed password for invalid user ftpuser from 0.0.0.0 port 62891 ssh2",
+	"Dec 10 09:12:35 LabSZ sshd[24492]: Failed password for invalid user pi from 0.0.0.0 port 49289 ssh2",
+	"Dec 10 09:12:44 LabSZ sshd[24501]: Failed password for invalid user ftpuser from 0.0.0.0 port 60836 ssh2",
+	"Dec 10 07:28:03 LabSZ sshd[24245]: input_userauth_request: invalid user pgadmin [preauth]",
+}
+
+func newTestMinerJsonMiner() *TemplateMiner {
+	clock := func() time.Time { return time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC) }
+	miner, _ := NewTemplateMiner(WithMaskInsturction("abc", "abc"), WithClock(clock))
+	for _, log := range testMinerLogs {
+		miner.AddLogMessage(log)
+	}
+	return miner
+}
+
 func TestToJson(t *testing.T) {
 	t.Run("test to json", func(t *testing.T) {
-		testJson := `{"Drain":{"MaxDepth":4,"Sim":0.4,"MaxChildren":100,"MaxClusters":1000,"ClusterCounter":2,"Clusters":[{"ID":1,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","input_userauth_request:","invalid","user","[*]","[preauth]"]},{"ID":2,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","Failed","password","for","invalid","user","[*]","from","0.0.0.0","port","[*]","ssh2"]}],"RootNode":{"NodeType":0,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren": {"10":{"NodeType":1,"Length":10,"TokenNodeChildren":{"Dec":{"NodeType":2,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren":{},"Clusters":[{"ID":1, "LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","input_userauth_request:","invalid","user","[*]","[preauth]"]}]}},"LengthNodeChildren":{},"Clusters":[]},"16":{"NodeType":1,"Length":16,"TokenNodeChildren":{"Dec":{"NodeType":2,"Length":0,"TokenNodeChildren":{},"LengthNodeChildren":{},"Clusters":[{"ID":2,"LogTemplateTokens":["Dec","10","[*]","LabSZ","[*]","Failed","password","for","invalid","user","[*]","from","0.0.0.0","port","[*]","ssh2"]}]}},"LengthNodeChildren":{},"Clusters":[]}},"Clusters":[]}},"Masker":{"Prefix":"[:","Suffix":":]","MaskInstructions":[{"Pattern":"abc","MaskWith":"abc"}]}}`
-
-		miner, _ := NewTemplateMiner(WithMaskInsturction("abc", "abc"))
-		rawLogs := []string{
-			"Dec 10 07:07:38 LabSZ sshd[24206]: input_userauth_request: invalid user test9 [preauth]",
-			"Dec 10 07:08:28 LabSZ sshd[24208]: input_userauth_request: invalid user webmaster [preauth]",
-			"Dec 10 09:12:32 LabSZ sshd[24490]: Failed password for invalid user ftpuser from 0.0.0.0 port 62891 ssh2",
-			"Dec 10 09:12:35 LabSZ sshd[24492]: Failed password for invalid user pi from 0.0.0.0 port 49289 ssh2",
-			"Dec 10 09:12:44 LabSZ sshd[24501]: Failed password for invalid user ftpuser from 0.0.0.0 port 60836 ssh2",
-			"Dec 10 07:28:03 LabSZ sshd[24245]: input_userauth_request: invalid user pgadmin [preauth]",
-		}
-		for _, log := range rawLogs {
-			miner.AddLogMessage(log)
-		}
+		testJson := testMinerJson
+
+		miner := newTestMinerJsonMiner()
 		b, err := json.Marshal(miner)
 		if err != nil {
 			t.Fatal(err)
@@ -79,7 +97,242 @@ func TestToJson(t *testing.T) {
 		if err := json.Unmarshal(b, &newMiner); err != nil {
 			t.Fatal(err)
 		}
-		assert.Equal(t, miner, &newMiner, "miner should match")
+		assert.Equal(t, clusterStates(miner), clusterStates(&newMiner))
+		expectedHash, _ := configHash(miner.masker, miner.drain)
+		hash, err := configHash(newMiner.masker, newMiner.drain)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedHash, hash)
+		for _, cluster := range miner.Clusters(CLUSTER_SORT_BY_ID) {
+			loaded := newMiner.GetCluster(cluster.ID())
+			assert.Equal(t, cluster.Lineage(), loaded.Lineage())
+			assert.Equal(t, cluster.History(), loaded.History())
+		}
+	})
+	t.Run("test snapshot without version", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		newMiner := TemplateMiner{}
+		if err := json.Unmarshal([]byte(testMinerJsonV1), &newMiner); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterTemplates(miner), clusterTemplates(&newMiner))
+		expectedHash, _ := configHash(miner.masker, miner.drain)
+		hash, err := configHash(newMiner.masker, newMiner.drain)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedHash, hash)
+		// the legacy snapshot has no statistics, lineage nor history
+		for _, cluster := range newMiner.Clusters(CLUSTER_SORT_BY_ID) {
+			assert.Equal(t, int64(0), cluster.Size())
+			assert.True(t, cluster.FirstSeen().IsZero())
+			assert.Empty(t, cluster.Lineage())
+			assert.Empty(t, cluster.History())
+		}
+	})
+	t.Run("test snapshot of a newer version", func(t *testing.T) {
+		newMiner := TemplateMiner{}
+		err := json.Unmarshal([]byte(`{"FormatVersion":99,`+testMinerJsonV1[1:]), &newMiner)
+		assert.True(t, errorIs(err, snapshotVersionError))
+	})
+	t.Run("test config hash mismatch", func(t *testing.T) {
+		newMiner := TemplateMiner{}
+		err := json.Unmarshal([]byte(strings.Replace(testMinerJson, "879ac636c69a9219", "0000000000000000", 1)), &newMiner)
+		assert.True(t, errorIs(err, snapshotCorruptedError))
+	})
+	t.Run("test config hash with several mask instructions", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+			WithMaskInsturction(`\b(?:\d{1,3}\.){3}\d{1,3}\b`, "IP"),
+			WithMaskInsturction(`\b0x[0-9a-f]+\b`, "HEX"),
+		)
+		miner.AddLogMessage("read 16 bytes at 0xff from 10.0.0.1")
+		for i := 0; i < 50; i++ {
+			b, _ := json.Marshal(miner)
+			newMiner := TemplateMiner{}
+			if err := json.Unmarshal(b, &newMiner); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, clusterStates(miner), clusterStates(&newMiner))
+		}
+	})
+}
+
+func TestConcurrentMiner(t *testing.T) {
+	t.Run("test mixed add match and save", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(
+			WithMaskInsturction(`\b(?:\d{1,3}\.){3}\d{1,3}\b`, "IP"),
+			WithDrainMaxCluster(50),
+		)
+		p := newTestRedisPersistence(newFakeRedisClient())
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(offset int) {
+				defer wg.Done()
+				for j := offset; j < len(testData); j += 4 {
+					resp := miner.AddLogMessage(testData[j])
+					assert.NotEmpty(t, resp.Cluster.getTemplate())
+				}
+			}(i)
+		}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(offset int) {
+				defer wg.Done()
+				for j := offset; j < len(testData); j += 4 {
+					if cluster := miner.Match(testData[j]); cluster != nil {
+						miner.ExtractClusterParameters(cluster, testData[j])
+					}
+				}
+			}(i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				assert.Nil(t, p.Save(context.Background(), miner))
+				miner.Status()
+			}
+		}()
+		wg.Wait()
+
+		assert.Nil(t, p.Save(context.Background(), miner))
+		loaded, err := p.Load(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, miner.Status(), loaded.Status())
+	})
+	t.Run("test concurrent responses", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		sizes := make(chan int64, 100)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					resp := miner.AddLogMessage("user alice logged in")
+					sizes <- resp.ClusterSize
+				}
+			}()
+		}
+		wg.Wait()
+		close(sizes)
+
+		// each response holds the size right after its own log message
+		seen := map[int64]bool{}
+		for size := range sizes {
+			assert.False(t, seen[size])
+			seen[size] = true
+		}
+		assert.Len(t, seen, 100)
+	})
+}
+
+func TestClusterStatistics(t *testing.T) {
+	t.Run("test size and seen times", func(t *testing.T) {
+		now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+		clock := func() time.Time { return now }
+		miner, _ := NewTemplateMiner(WithClock(clock))
+
+		resp := miner.AddLogMessage("user alice logged in")
+		assert.Equal(t, int64(1), resp.ClusterSize)
+		assert.Equal(t, now, resp.FirstSeen)
+		assert.Equal(t, now, resp.LastSeen)
+
+		first := now
+		now = now.Add(time.Minute)
+		miner.AddLogMessage("user bob logged in")
+		now = now.Add(time.Minute)
+		resp = miner.AddLogMessage("user carol logged in")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NONE, resp.ChangeType)
+		assert.Equal(t, int64(3), resp.ClusterSize)
+		assert.Equal(t, first, resp.FirstSeen)
+		assert.Equal(t, now, resp.LastSeen)
+		assert.Equal(t, int64(3), resp.Cluster.Size())
+		assert.Equal(t, first, resp.Cluster.FirstSeen())
+		assert.Equal(t, now, resp.Cluster.LastSeen())
+	})
+	t.Run("test statistics survive redis round trip", func(t *testing.T) {
+		now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+		miner, _ := NewTemplateMiner(WithClock(func() time.Time { return now }))
+		for i := 0; i < 5; i++ {
+			miner.AddLogMessage("job finished")
+		}
+		p := newTestRedisPersistence(newFakeRedisClient())
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster := loaded.Match("job finished")
+		assert.Equal(t, int64(5), cluster.Size())
+		assert.Equal(t, now, cluster.FirstSeen())
+		assert.Equal(t, now, cluster.LastSeen())
+	})
+}
+
+func TestMatchWithStrategy(t *testing.T) {
+	miner, _ := NewTemplateMiner()
+	miner.AddLogMessage("1abc b c")
+	miner.AddLogMessage("2abc b c")
+	miner.AddLogMessage("zzz q r")
+
+	t.Run("test tree search misses", func(t *testing.T) {
+		assert.Nil(t, miner.Match("zzz b c"))
+		assert.Nil(t, miner.MatchWithStrategy("zzz b c", SEARCH_STRATEGY_NEVER))
+	})
+	t.Run("test fallback search", func(t *testing.T) {
+		res := miner.MatchWithStrategy("zzz b c", SEARCH_STRATEGY_FALLBACK)
+		assert.NotNil(t, res)
+		assert.Equal(t, "[*] b c", res.Cluster.Template())
+		assert.Equal(t, float32(1), res.Similarity)
+		assert.Equal(t, int64(1), res.ParamCount)
+
+		res = miner.MatchWithStrategy("zzz q r", SEARCH_STRATEGY_FALLBACK)
+		assert.Equal(t, "zzz q r", res.Cluster.Template())
+		assert.Equal(t, int64(0), res.ParamCount)
+	})
+	t.Run("test always search", func(t *testing.T) {
+		res := miner.MatchWithStrategy("3abc b c", SEARCH_STRATEGY_ALWAYS)
+		assert.Equal(t, "[*] b c", res.Cluster.Template())
+		assert.Nil(t, miner.MatchWithStrategy("a b c d", SEARCH_STRATEGY_ALWAYS))
+	})
+	t.Run("test minimum similarity", func(t *testing.T) {
+		res := miner.MatchWithStrategy("zzz b c", SEARCH_STRATEGY_NEVER, WithMatchSimilarity(0.3))
+		assert.NotNil(t, res)
+		assert.Equal(t, "zzz q r", res.Cluster.Template())
+		assert.Equal(t, float32(1)/3, res.Similarity)
+		assert.Nil(t, miner.MatchWithStrategy("zzz b c", SEARCH_STRATEGY_NEVER, WithMatchSimilarity(0.5)))
+	})
+}
+
+func TestWithPersistence(t *testing.T) {
+	t.Run("test fresh miner without snapshot", func(t *testing.T) {
+		p := NewFilePersistence(t.TempDir(), "miner")
+		miner, err := NewTemplateMiner(WithPersistence(p), WithMaskInsturction(`\d+`, "NUM"))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, miner.drain.GetTotalClusterSize())
+		assert.Equal(t, "a [:NUM:]", miner.AddLogMessage("a 1").TemplateMined)
+	})
+	t.Run("test restore snapshot", func(t *testing.T) {
+		p := newTestRedisPersistence(newFakeRedisClient())
+		_, err := p.Load(context.Background())
+		assert.True(t, errorIs(err, snapshotNotFoundError))
+
+		saved := newTestMiner(t, 100)
+		assert.Nil(t, p.Save(context.Background(), saved))
+		now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+		miner, err := NewTemplateMiner(WithPersistence(p), WithClock(func() time.Time { return now }))
+		assert.Nil(t, err)
+		assert.Equal(t, saved.Status(), miner.Status())
+		assert.Equal(t, now, miner.AddLogMessage("a brand new message").LastSeen)
+	})
+	t.Run("test restore error", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.Nil(t, os.WriteFile(dir+"/miner.00000000000000000001.snapshot", []byte("garbage\n"), 0o644))
+		miner, err := NewTemplateMiner(WithPersistence(NewFilePersistence(dir, "miner")))
+		assert.Nil(t, miner)
+		assert.True(t, errorIs(err, snapshotCorruptedError))
 	})
 }
 
@@ -0,0 +1,187 @@
+package loggingdrain
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// WILDCARD_MASK_NAME is the mask name reported for a parameter that was
+// captured by a drain wildcard instead of a mask instruction.
+const WILDCARD_MASK_NAME = "wildcard"
+
+type ExtractedParameter struct {
+	// Value is the part of the raw message replaced by the parameter.
+	Value string
+	// Position is the index of the template token holding the parameter.
+	Position int
+	// MaskName is the name of the mask instruction that replaced the value,
+	// "NUM" for the placeholder "[:NUM:]", or WILDCARD_MASK_NAME ("wildcard")
+	// when the value was replaced by the drain wildcard "[*]".
+	MaskName string
+}
+
+type parameterExtractor struct {
+	re     *regexp.Regexp
+	params []extractorParam
+}
+
+type extractorParam struct {
+	group    int
+	position int
+	maskName string
+}
+
+// ExtractParameters returns the values of message that were replaced by the
+// wildcards and masks of logTemplate, in template order.
+//
+// Masks are matched with the pattern of their mask instruction, so masks
+// spanning several tokens of the raw message are supported, wildcards match
+// any text. A TemplateMismatchError is returned when message does not fit
+// logTemplate.
+func (miner *TemplateMiner) ExtractParameters(logTemplate, message string) ([]ExtractedParameter, error) {
+	return miner.extractParameters(miner.drain.tokenize(logTemplate), message)
+}
+
+// ExtractClusterParameters is like ExtractParameters, using the current
+// template of cluster.
+func (miner *TemplateMiner) ExtractClusterParameters(cluster *LogCluster, message string) ([]ExtractedParameter, error) {
+	return miner.extractParameters(cluster.Tokens(), message)
+}
+
+func (miner *TemplateMiner) extractParameters(templateTokens []string, message string) ([]ExtractedParameter, error) {
+	extractor, err := miner.masker.parameterExtractor(templateTokens, miner.drain.tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	params, ok := extractor.extract(message)
+	if !ok {
+		return nil, errTemplateMismatchRaw(
+			fmt.Sprintf("message %q does not match template %q", message, strings.Join(templateTokens, " ")))
+	}
+	return params, nil
+}
+
+// parameterExtractor builds a regexp matching raw messages of the template,
+// with one capture group for every wildcard and mask of the template, and the
+// separators of the tokenizer between the tokens.
+func (mask *logMasker) parameterExtractor(templateTokens []string, tokenizer tokenizer) (*parameterExtractor, error) {
+	names := mask.maskNames()
+	// longest names first, so the lookup of a placeholder is deterministic
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	extractor := &parameterExtractor{}
+	groupCount := 0
+	var b strings.Builder
+	separator, keySeparator := tokenizer.separators()
+	b.WriteString(`^` + keySeparator)
+	for position, token := range templateTokens {
+		if position > 0 && tokenizer.splitsAfter(templateTokens[position-1]) {
+			b.WriteString(keySeparator)
+		} else if position > 0 {
+			b.WriteString(separator)
+		}
+		if token == default_wildcard_str {
+			groupCount += 1
+			extractor.params = append(extractor.params, extractorParam{
+				group:    groupCount,
+				position: position,
+				maskName: WILDCARD_MASK_NAME,
+			})
+			b.WriteString(`(.+?)`)
+			continue
+		}
+		rest := token
+		for len(rest) > 0 {
+			index, name := mask.findPlaceholder(rest, names)
+			if index < 0 {
+				b.WriteString(regexp.QuoteMeta(rest))
+				break
+			}
+			pattern, groups := mask.namePattern(name)
+			groupCount += 1
+			extractor.params = append(extractor.params, extractorParam{
+				group:    groupCount,
+				position: position,
+				maskName: name,
+			})
+			b.WriteString(regexp.QuoteMeta(rest[:index]))
+			b.WriteString("(" + pattern + ")")
+			groupCount += groups
+			rest = rest[index+len(mask.placeholder(name)):]
+		}
+	}
+	b.WriteString(keySeparator + `$`)
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	extractor.re = re
+	return extractor, nil
+}
+
+// unanchoredPattern removes the line and text anchors of pattern, which
+// would never match in the middle of the extractor regexp. The capture groups
+// are kept.
+func unanchoredPattern(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return pattern
+	}
+	var unanchor func(re *syntax.Regexp)
+	unanchor = func(re *syntax.Regexp) {
+		switch re.Op {
+		case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText:
+			re.Op = syntax.OpEmptyMatch
+		}
+		for _, sub := range re.Sub {
+			unanchor(sub)
+		}
+	}
+	unanchor(re)
+	return re.String()
+}
+
+// findPlaceholder returns the index of the first mask placeholder in token
+// and the mask name it stands for, or -1 when token has no placeholder.
+func (mask *logMasker) findPlaceholder(token string, names []string) (int, string) {
+	firstIndex, firstName := -1, ""
+	for _, name := range names {
+		index := strings.Index(token, mask.placeholder(name))
+		if index < 0 {
+			continue
+		}
+		if firstIndex < 0 || index < firstIndex {
+			firstIndex, firstName = index, name
+		}
+	}
+	return firstIndex, firstName
+}
+
+func (mask *logMasker) placeholder(name string) string {
+	return mask.prefix + name + mask.suffix
+}
+
+func (extractor *parameterExtractor) extract(message string) ([]ExtractedParameter, bool) {
+	match := extractor.re.FindStringSubmatch(message)
+	if match == nil {
+		return nil, false
+	}
+	params := make([]ExtractedParameter, 0, len(extractor.params))
+	for _, p := range extractor.params {
+		params = append(params, ExtractedParameter{
+			Value:    match[p.group],
+			Position: p.position,
+			MaskName: p.maskName,
+		})
+	}
+	return params, true
+}
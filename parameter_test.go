@@ -0,0 +1,75 @@
+package loggingdrain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractParameters(t *testing.T) {
+	t.Run("test wildcard parameters", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		miner.AddLogMessage("user alice logged in from web")
+		resp := miner.AddLogMessage("user bob logged in from mobile")
+		assert.Equal(t, "user [*] logged in from [*]", resp.TemplateMined)
+
+		params, err := miner.ExtractClusterParameters(resp.Cluster, "user  carol logged in from cli")
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "carol", Position: 1, MaskName: WILDCARD_MASK_NAME},
+			{Value: "cli", Position: 5, MaskName: WILDCARD_MASK_NAME},
+		}, params)
+		assert.Equal(t, "wildcard", params[0].MaskName)
+	})
+	t.Run("test mask parameters", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(
+			WithMaskInsturction(`\b(?:\d{1,3}\.){3}\d{1,3}\b`, "IP"),
+			WithMaskInsturction(`\b\d{4,}\b`, "NUM"),
+		)
+		message := "connect to 10.0.0.1 port=8080 took 1200 ms"
+		resp := miner.AddLogMessage(message)
+
+		params, err := miner.ExtractParameters(resp.TemplateMined, message)
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "10.0.0.1", Position: 2, MaskName: "IP"},
+			{Value: "8080", Position: 3, MaskName: "NUM"},
+			{Value: "1200", Position: 5, MaskName: "NUM"},
+		}, params)
+	})
+	t.Run("test multi token mask", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithMaskInsturction(`\d+ (?:ms|s)\b`, "DURATION"))
+		message := "request done in 150 ms status ok"
+		resp := miner.AddLogMessage(message)
+		assert.Equal(t, "request done in [:DURATION:] status ok", resp.TemplateMined)
+
+		params, err := miner.ExtractParameters(resp.TemplateMined, "request done in 3 s status ok")
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "3 s", Position: 3, MaskName: "DURATION"},
+		}, params)
+	})
+	t.Run("test template mismatch", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithMaskInsturction(`\b\d+\b`, "NUM"))
+		_, err := miner.ExtractParameters("read [:NUM:] bytes", "read many bytes")
+		assert.True(t, errorIs(err, templateMismatchError))
+		_, err = miner.ExtractParameters("read [*] bytes", "write 3 bytes")
+		assert.True(t, errorIs(err, templateMismatchError))
+	})
+	t.Run("test anchored mask pattern", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithMaskInsturction(`^\d+$`, "NUM"), WithMaskInsturction(`\A(\w+):`, "LEVEL"))
+		params, err := miner.ExtractParameters("[:LEVEL:] retry [:NUM:] of [:NUM:]", "warn: retry 1 of 3")
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "warn:", Position: 0, MaskName: "LEVEL"},
+			{Value: "1", Position: 2, MaskName: "NUM"},
+			{Value: "3", Position: 4, MaskName: "NUM"},
+		}, params)
+	})
+	t.Run("test template without parameters", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		params, err := miner.ExtractParameters("service (re)started", "service (re)started")
+		assert.Nil(t, err)
+		assert.Empty(t, params)
+	})
+}
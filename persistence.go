@@ -2,7 +2,11 @@ package loggingdrain
 
 import "context"
 
-type persistenceHandler interface {
+// PersistenceHandler saves and loads the state of a miner.
+//
+// Load returns a SnapshotNotFoundError when nothing was saved yet, so that
+// callers can tell a fresh start apart from a failing storage.
+type PersistenceHandler interface {
 	Save(context.Context, *TemplateMiner) error
 	Load(context.Context) (*TemplateMiner, error)
 }
@@ -0,0 +1,254 @@
+package loggingdrain
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	default_save_debounce          = time.Second
+	default_save_retry_backoff     = time.Second
+	default_save_max_retry_backoff = time.Minute
+)
+
+// PersistenceManager saves a miner with a persistence handler in the
+// background, so that callers do not have to save it themselves.
+//
+// A save is triggered periodically when the miner changed since the last
+// save (WithSaveInterval), and after a number of cluster changes
+// (WithSaveOnChanges); saves triggered by changes are debounced so a burst
+// of new clusters results in a single save. Failed saves are reported to the
+// error handler and retried with an exponential backoff. Close saves the
+// pending changes before returning.
+type PersistenceManager struct {
+	miner   *TemplateMiner
+	handler PersistenceHandler
+	conf    persistenceManagerConfig
+
+	// changes counts the new, updated and deleted clusters and the metadata
+	// changes since the last save, dirty is set by any added log message
+	// since cluster sizes changed.
+	changes int64
+	dirty   int32
+
+	removeListener func()
+	notify         chan struct{}
+	// stop is closed by Close, cancel cancels the context of the background
+	// saves and stopped is closed once run returned.
+	stop      chan struct{}
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewPersistenceManager starts saving miner with handler in the background.
+func NewPersistenceManager(miner *TemplateMiner, handler PersistenceHandler, options ...persistenceManagerOption) *PersistenceManager {
+	m := &PersistenceManager{
+		miner:   miner,
+		handler: handler,
+		conf:    newPersistenceManagerConfig(options),
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.removeListener = miner.listeners.add(m.onChange)
+	go m.run(ctx)
+	return m
+}
+
+// Close stops the background saves and saves the pending changes with ctx.
+// It returns the error of this last save. The context of a background save
+// in progress is cancelled, the pending changes are not saved when ctx is
+// done before that save returns.
+func (m *PersistenceManager) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		m.removeListener()
+		close(m.stop)
+		m.cancel()
+		select {
+		case <-m.stopped:
+		case <-ctx.Done():
+			m.closeErr = errInternal(ctx.Err())
+			return
+		}
+		if atomic.LoadInt32(&m.dirty) == 1 {
+			m.closeErr = m.save(ctx)
+		}
+	})
+	return m.closeErr
+}
+
+func (m *PersistenceManager) onChange(updateType ClusterUpdateType, cluster *LogCluster) {
+	if atomic.LoadInt32(&m.dirty) == 0 {
+		atomic.StoreInt32(&m.dirty, 1)
+	}
+	if updateType == CLUSTER_UPDATE_TYPE_NONE || m.conf.ChangeThreshold <= 0 {
+		return
+	}
+	if atomic.AddInt64(&m.changes, 1) >= int64(m.conf.ChangeThreshold) {
+		select {
+		case m.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *PersistenceManager) run(ctx context.Context) {
+	defer close(m.stopped)
+	var tick <-chan time.Time
+	if m.conf.Interval > 0 {
+		ticker := time.NewTicker(m.conf.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var debounce, retry <-chan time.Time
+	backoff := m.conf.RetryBackoff
+	attempt := func() {
+		err := m.save(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			retry = nil
+			backoff = m.conf.RetryBackoff
+			return
+		}
+		if m.conf.OnError != nil {
+			m.conf.OnError(err)
+		}
+		retry = time.After(backoff)
+		backoff *= 2
+		if backoff > m.conf.MaxRetryBackoff {
+			backoff = m.conf.MaxRetryBackoff
+		}
+	}
+
+	for {
+		// a stop pending with other events is handled first
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-tick:
+			if retry == nil && atomic.LoadInt32(&m.dirty) == 1 {
+				attempt()
+			}
+		case <-m.notify:
+			if retry == nil && debounce == nil {
+				debounce = time.After(m.conf.Debounce)
+			}
+		case <-debounce:
+			debounce = nil
+			if retry == nil {
+				attempt()
+			}
+		case <-retry:
+			retry = nil
+			attempt()
+		}
+	}
+}
+
+// save saves the miner, the changes made while saving are kept pending.
+func (m *PersistenceManager) save(ctx context.Context) error {
+	changes := atomic.SwapInt64(&m.changes, 0)
+	atomic.StoreInt32(&m.dirty, 0)
+	if err := m.handler.Save(ctx, m.miner); err != nil {
+		atomic.AddInt64(&m.changes, changes)
+		atomic.StoreInt32(&m.dirty, 1)
+		return err
+	}
+	return nil
+}
+
+type persistenceManagerConfig struct {
+	Interval        time.Duration
+	ChangeThreshold int
+	Debounce        time.Duration
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	OnError         func(error)
+}
+
+func newPersistenceManagerConfig(options []persistenceManagerOption) persistenceManagerConfig {
+	conf := persistenceManagerConfig{
+		Debounce:        default_save_debounce,
+		RetryBackoff:    default_save_retry_backoff,
+		MaxRetryBackoff: default_save_max_retry_backoff,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	if conf.RetryBackoff <= 0 {
+		conf.RetryBackoff = default_save_retry_backoff
+	}
+	if conf.MaxRetryBackoff < conf.RetryBackoff {
+		conf.MaxRetryBackoff = conf.RetryBackoff
+	}
+	return conf
+}
+
+// WithSaveInterval saves the miner every interval when it changed.
+func WithSaveInterval(interval time.Duration) persistenceManagerOption {
+	return persistenceManagerOptionFunc(func(conf persistenceManagerConfig) persistenceManagerConfig {
+		conf.Interval = interval
+		return conf
+	})
+}
+
+// WithSaveOnChanges saves the miner once threshold cluster changes happened
+// since the last save: the clusters created, updated, deleted or renumbered
+// by a TemplateSync, and the pins and names set.
+func WithSaveOnChanges(threshold int) persistenceManagerOption {
+	return persistenceManagerOptionFunc(func(conf persistenceManagerConfig) persistenceManagerConfig {
+		conf.ChangeThreshold = threshold
+		return conf
+	})
+}
+
+// WithSaveDebounce sets how long a save triggered by changes waits for
+// further changes, 1s by default.
+func WithSaveDebounce(debounce time.Duration) persistenceManagerOption {
+	return persistenceManagerOptionFunc(func(conf persistenceManagerConfig) persistenceManagerConfig {
+		conf.Debounce = debounce
+		return conf
+	})
+}
+
+// WithSaveRetryBackoff sets the delay before retrying a failed save, doubled
+// after every failure up to max. It is 1s up to 1m by default.
+func WithSaveRetryBackoff(initial, max time.Duration) persistenceManagerOption {
+	return persistenceManagerOptionFunc(func(conf persistenceManagerConfig) persistenceManagerConfig {
+		conf.RetryBackoff = initial
+		conf.MaxRetryBackoff = max
+		return conf
+	})
+}
+
+// WithSaveErrorHandler sets the function called with the error of every
+// failed background save.
+func WithSaveErrorHandler(onError func(error)) persistenceManagerOption {
+	return persistenceManagerOptionFunc(func(conf persistenceManagerConfig) persistenceManagerConfig {
+		conf.OnError = onError
+		return conf
+	})
+}
+
+type persistenceManagerOption interface {
+	apply(persistenceManagerConfig) persistenceManagerConfig
+}
+
+type persistenceManagerOptionFunc func(persistenceManagerConfig) persistenceManagerConfig
+
+func (o persistenceManagerOptionFunc) apply(conf persistenceManagerConfig) persistenceManagerConfig {
+	return o(conf)
+}
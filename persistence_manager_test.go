@@ -0,0 +1,177 @@
+package loggingdrain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePersistence struct {
+	mu       sync.Mutex
+	saves    int
+	failures int
+	saved    []byte
+}
+
+func (p *fakePersistence) Save(ctx context.Context, miner *TemplateMiner) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures -= 1
+		return errInternal(errors.New("save failed"))
+	}
+	b, err := miner.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	p.saves += 1
+	p.saved = b
+	return nil
+}
+
+func (p *fakePersistence) Load(ctx context.Context) (*TemplateMiner, error) {
+	return nil, errInternalRaw("not implemented")
+}
+
+func (p *fakePersistence) saveCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saves
+}
+
+// blockingPersistence blocks every save until release is closed, ignoring
+// the context.
+type blockingPersistence struct {
+	fakePersistence
+	release chan struct{}
+	calls   int32
+}
+
+func (p *blockingPersistence) Save(ctx context.Context, miner *TemplateMiner) error {
+	atomic.AddInt32(&p.calls, 1)
+	<-p.release
+	return p.fakePersistence.Save(ctx, miner)
+}
+
+func TestPersistenceManager(t *testing.T) {
+	t.Run("test save on changes", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &fakePersistence{}
+		m := NewPersistenceManager(miner, p, WithSaveOnChanges(3), WithSaveDebounce(20*time.Millisecond))
+		defer m.Close(context.Background())
+
+		miner.AddLogMessage("a")
+		miner.AddLogMessage("a")
+		miner.AddLogMessage("b")
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 0, p.saveCount())
+
+		for i := 0; i < 10; i++ {
+			miner.AddLogMessage(fmt.Sprintf("message%d", i))
+		}
+		assert.Eventually(t, func() bool { return p.saveCount() == 1 }, time.Second, 5*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 1, p.saveCount())
+	})
+	t.Run("test save on admin changes", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		miner.AddLogMessage("a")
+		miner.AddLogMessage("b")
+		p := &fakePersistence{}
+		m := NewPersistenceManager(miner, p, WithSaveOnChanges(3), WithSaveDebounce(time.Millisecond))
+		defer m.Close(context.Background())
+
+		assert.Nil(t, miner.PinCluster(1))
+		assert.Nil(t, miner.SetClusterName(1, "a"))
+		assert.Nil(t, miner.DeleteCluster(2))
+		assert.Eventually(t, func() bool { return p.saveCount() == 1 }, time.Second, 5*time.Millisecond)
+	})
+	t.Run("test save on interval", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &fakePersistence{}
+		m := NewPersistenceManager(miner, p, WithSaveInterval(10*time.Millisecond))
+		defer m.Close(context.Background())
+
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, 0, p.saveCount())
+		miner.AddLogMessage("a")
+		assert.Eventually(t, func() bool { return p.saveCount() == 1 }, time.Second, 5*time.Millisecond)
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, 1, p.saveCount())
+	})
+	t.Run("test retry failed save", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &fakePersistence{failures: 2}
+		errs := make(chan error, 10)
+		m := NewPersistenceManager(miner, p,
+			WithSaveOnChanges(1),
+			WithSaveDebounce(0),
+			WithSaveRetryBackoff(5*time.Millisecond, 10*time.Millisecond),
+			WithSaveErrorHandler(func(err error) { errs <- err }),
+		)
+		defer m.Close(context.Background())
+
+		miner.AddLogMessage("a")
+		assert.Eventually(t, func() bool { return p.saveCount() == 1 }, time.Second, 5*time.Millisecond)
+		assert.Len(t, errs, 2)
+		assert.True(t, errorIs(<-errs, internalError))
+	})
+	t.Run("test flush on close", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &fakePersistence{}
+		m := NewPersistenceManager(miner, p)
+		miner.AddLogMessage("a b c")
+		miner.AddLogMessage("a b d")
+		assert.Equal(t, 0, p.saveCount())
+
+		assert.Nil(t, m.Close(context.Background()))
+		assert.Equal(t, 1, p.saveCount())
+		loaded := TemplateMiner{}
+		assert.Nil(t, loaded.UnmarshalJSON(p.saved))
+		assert.Equal(t, miner.Status(), loaded.Status())
+
+		miner.AddLogMessage("x y z")
+		assert.Nil(t, m.Close(context.Background()))
+		assert.Equal(t, 1, p.saveCount())
+	})
+	t.Run("test close without changes", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &fakePersistence{}
+		m := NewPersistenceManager(miner, p)
+		assert.Nil(t, m.Close(context.Background()))
+		assert.Equal(t, 0, p.saveCount())
+	})
+	t.Run("test close with a blocked save", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		p := &blockingPersistence{release: make(chan struct{})}
+		m := NewPersistenceManager(miner, p,
+			WithSaveInterval(5*time.Millisecond),
+			WithSaveRetryBackoff(5*time.Millisecond, 5*time.Millisecond),
+		)
+		miner.AddLogMessage("a")
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&p.calls) == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := m.Close(ctx)
+		assert.True(t, errorIs(err, internalError))
+
+		// the background save returns and no other save is started
+		miner.AddLogMessage("b")
+		close(p.release)
+		select {
+		case <-m.stopped:
+		case <-time.After(time.Second):
+			t.Fatal("the manager kept running after Close")
+		}
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&p.calls))
+		assert.Equal(t, err, m.Close(context.Background()))
+	})
+}
@@ -0,0 +1,58 @@
+package loggingdrain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Redact returns message with the values of the template it matches replaced
+// by the wildcard and mask placeholders, keeping the whitespace and the
+// delimiters of message unchanged. The miner is not updated. When no cluster
+// matches, only the masks are applied.
+func (miner *TemplateMiner) Redact(message string) string {
+	if cluster := miner.Match(message); cluster != nil {
+		if redacted, err := miner.RedactWithCluster(cluster, message); err == nil {
+			return redacted
+		}
+	}
+	return miner.masker.mask(message)
+}
+
+// RedactWithCluster is like Redact, using the current template of cluster. A
+// TemplateMismatchError is returned when message does not fit it.
+func (miner *TemplateMiner) RedactWithCluster(cluster *LogCluster, message string) (string, error) {
+	templateTokens := cluster.Tokens()
+	extractor, err := miner.masker.parameterExtractor(templateTokens, miner.drain.tokenizer)
+	if err != nil {
+		return "", err
+	}
+	redacted, ok := extractor.redact(message, miner.masker)
+	if !ok {
+		return "", errTemplateMismatchRaw(
+			fmt.Sprintf("message %q does not match template %q", message, strings.Join(templateTokens, " ")))
+	}
+	return redacted, nil
+}
+
+// redact replaces the capture groups of the parameters with their
+// placeholders, the text between them is copied from message.
+func (extractor *parameterExtractor) redact(message string, mask *logMasker) (string, bool) {
+	match := extractor.re.FindStringSubmatchIndex(message)
+	if match == nil {
+		return "", false
+	}
+	var b strings.Builder
+	last := 0
+	for _, p := range extractor.params {
+		start, end := match[2*p.group], match[2*p.group+1]
+		b.WriteString(message[last:start])
+		if p.maskName == WILDCARD_MASK_NAME {
+			b.WriteString(default_wildcard_str)
+		} else {
+			b.WriteString(mask.placeholder(p.maskName))
+		}
+		last = end
+	}
+	b.WriteString(message[last:])
+	return b.String(), true
+}
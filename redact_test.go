@@ -0,0 +1,44 @@
+package loggingdrain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	t.Run("test whitespace is preserved", func(t *testing.T) {
+		miner, err := NewTemplateMiner(WithMaskPresets(MASK_PRESET_IPV4, MASK_PRESET_NUM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("user alice  logged in\tfrom 10.0.0.1 port 22")
+		cluster := miner.AddLogMessage("user bob  logged in\tfrom 10.0.0.2 port 23").Cluster
+		assert.Equal(t, "user [*] logged in from [:IP:] port [:NUM:]", cluster.Template())
+
+		message := "  user carol  logged in\tfrom 10.0.0.3 port 24\n"
+		assert.Equal(t, "  user [*]  logged in\tfrom [:IP:] port [:NUM:]\n", miner.Redact(message))
+		assert.Equal(t, int64(2), cluster.Size())
+
+		// without a matching cluster only the masks apply
+		assert.Equal(t, "disk  [:NUM:]\tfailed", miner.Redact("disk  7\tfailed"))
+	})
+	t.Run("test delimiters are preserved", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithExtraDelimiters(","), WithKeyValueSplitting())
+		miner.AddLogMessage("user=alice,status=200")
+		miner.AddLogMessage("user=bob,status=500")
+		assert.Equal(t, "user=[*], status=[*]", miner.Redact("user=carol, status=404"))
+	})
+	t.Run("test redact with cluster", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		miner.AddLogMessage("user alice logged in")
+		cluster := miner.AddLogMessage("user bob logged in").Cluster
+
+		redacted, err := miner.RedactWithCluster(cluster, "user  carol logged in")
+		assert.Nil(t, err)
+		assert.Equal(t, "user  [*] logged in", redacted)
+
+		_, err = miner.RedactWithCluster(cluster, "user carol logged out")
+		assert.True(t, errorIs(err, templateMismatchError))
+	})
+}
@@ -0,0 +1,436 @@
+package loggingdrain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	default_compaction_threshold = 10000
+	default_hset_batch_size      = 1000
+
+	// redis_incremental_format_version is the version of the meta key,
+	// bumped whenever the layout of the meta, the clusters or the change log
+	// changes.
+	redis_incremental_format_version = 1
+)
+
+// RedisIncrementalClient for mock testing
+type RedisIncrementalClient interface {
+	RedisClient
+	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd
+	RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+}
+
+var _ RedisIncrementalClient = &redis.Client{}
+
+// RedisIncrementalPersistence saves a miner without rewriting all of its
+// clusters on every save.
+//
+// The clusters of the last full snapshot are stored in a hash keyed by
+// cluster id, and every save appends the clusters created, updated or
+// evicted since the previous save to a change log. Once the change log holds
+// more entries than the compaction threshold, the next save writes a new
+// full snapshot and drops the change log. The snapshots are numbered by a
+// generation stored in the meta key, which is switched only once a new
+// snapshot is complete.
+//
+// The handler remembers what it saved, so it shall save a single miner and
+// be the only writer of its service key. The first save of a handler which
+// did not load the miner is a full snapshot.
+type RedisIncrementalPersistence struct {
+	serviceKey          string
+	rdb                 RedisIncrementalClient
+	compactionThreshold int
+
+	// mu guards the state of the last save.
+	mu         sync.Mutex
+	generation int64
+	logLength  int
+	saved      map[int64]clusterVersion
+}
+
+// clusterVersion identifies the state of a cluster as saved.
+type clusterVersion struct {
+	size     int64
+	lastSeen int64
+	template string
+	name     string
+	pinned   bool
+	locked   bool
+}
+
+type redisIncrementalMeta struct {
+	FormatVersion int
+	Generation    int64
+	Masker        *logMasker
+
+	MaxDepth        int
+	Sim             float32
+	MaxChildren     int
+	MaxClusters     int
+	ClusterIDOffset int64
+	ClusterIDStride int64
+	ClusterCounter  int64
+	EvictionPolicy  EvictionPolicy `json:",omitempty"`
+	HistorySize     int            `json:",omitempty"`
+
+	Tokenizer *tokenizerMarshalStruct `json:",omitempty"`
+
+	// Order lists the cluster ids from the least to the most recently used,
+	// so that the evictions of a loaded miner are the same.
+	Order []int64
+}
+
+type clusterChangeEntry struct {
+	ID      int64
+	Evicted bool        `json:",omitempty"`
+	Cluster *LogCluster `json:",omitempty"`
+}
+
+var _ PersistenceHandler = &RedisIncrementalPersistence{}
+
+func NewRedisIncrementalPersistence(addr, password string, db int, serviceKey string,
+	options ...redisIncrementalOption) *RedisIncrementalPersistence {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+	return newRedisIncrementalPersistence(rdb, serviceKey, options...)
+}
+
+func newRedisIncrementalPersistence(rdb RedisIncrementalClient, serviceKey string,
+	options ...redisIncrementalOption) *RedisIncrementalPersistence {
+	conf := newRedisIncrementalConfig(options)
+	return &RedisIncrementalPersistence{
+		serviceKey:          serviceKey,
+		rdb:                 rdb,
+		compactionThreshold: conf.CompactionThreshold,
+	}
+}
+
+// Save appends the changes of template since the previous save to the change
+// log, or writes a full snapshot when the change log is due for compaction.
+func (p *RedisIncrementalPersistence) Save(ctx context.Context, template *TemplateMiner) error {
+	clusters, counter := template.drain.snapshotClusters()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saved == nil || p.logLength >= p.compactionThreshold {
+		return p.compact(ctx, template, clusters, counter)
+	}
+
+	current := make(map[int64]clusterVersion, len(clusters))
+	entries := []interface{}{}
+	for _, cluster := range clusters {
+		version := versionOf(cluster)
+		current[cluster.id] = version
+		if saved, ok := p.saved[cluster.id]; ok && saved == version {
+			continue
+		}
+		b, err := json.Marshal(&clusterChangeEntry{ID: cluster.id, Cluster: cluster})
+		if err != nil {
+			return errInternal(err)
+		}
+		entries = append(entries, string(b))
+	}
+	evicted := []int64{}
+	for id := range p.saved {
+		if _, ok := current[id]; !ok {
+			evicted = append(evicted, id)
+		}
+	}
+	sort.Slice(evicted, func(i, j int) bool { return evicted[i] < evicted[j] })
+	for _, id := range evicted {
+		b, err := json.Marshal(&clusterChangeEntry{ID: id, Evicted: true})
+		if err != nil {
+			return errInternal(err)
+		}
+		entries = append(entries, string(b))
+	}
+
+	if len(entries) > 0 {
+		if err := p.rdb.RPush(ctx, p.changeLogKey(p.generation), entries...).Err(); err != nil {
+			return errInternal(err)
+		}
+	}
+	// the cluster counter changes with the clusters
+	if err := p.saveMeta(ctx, template, clusters, p.generation, counter); err != nil {
+		return err
+	}
+	p.saved = current
+	p.logLength += len(entries)
+	return nil
+}
+
+// Compact writes a full snapshot of template and drops the change log.
+func (p *RedisIncrementalPersistence) Compact(ctx context.Context, template *TemplateMiner) error {
+	clusters, counter := template.drain.snapshotClusters()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compact(ctx, template, clusters, counter)
+}
+
+func (p *RedisIncrementalPersistence) compact(ctx context.Context, template *TemplateMiner,
+	clusters []*LogCluster, counter int64) error {
+	previous, err := p.loadMeta(ctx)
+	if err != nil && !errorIs(err, snapshotNotFoundError) {
+		return err
+	}
+	generation := int64(1)
+	if previous != nil {
+		generation = previous.Generation + 1
+	}
+
+	// a compaction which failed may have left the hash behind
+	clustersKey := p.clustersKey(generation)
+	if err := p.rdb.Del(ctx, clustersKey, p.changeLogKey(generation)).Err(); err != nil {
+		return errInternal(err)
+	}
+	current := make(map[int64]clusterVersion, len(clusters))
+	values := []interface{}{}
+	for i, cluster := range clusters {
+		current[cluster.id] = versionOf(cluster)
+		b, err := json.Marshal(cluster)
+		if err != nil {
+			return errInternal(err)
+		}
+		values = append(values, strconv.FormatInt(cluster.id, 10), string(b))
+		if len(values) == 2*default_hset_batch_size || i == len(clusters)-1 {
+			if err := p.rdb.HSet(ctx, clustersKey, values...).Err(); err != nil {
+				return errInternal(err)
+			}
+			values = values[:0]
+		}
+	}
+	if err := p.saveMeta(ctx, template, clusters, generation, counter); err != nil {
+		return err
+	}
+	p.generation = generation
+	p.saved = current
+	p.logLength = 0
+
+	if previous != nil {
+		if err := p.rdb.Del(ctx, p.clustersKey(previous.Generation), p.changeLogKey(previous.Generation)).Err(); err != nil {
+			return errInternal(err)
+		}
+	}
+	return nil
+}
+
+// Load rebuilds the miner from the clusters of the last full snapshot and
+// the change log, the prefix tree is rebuilt from the clusters and the cache
+// order of the last save is restored. A SnapshotCorruptedError is returned
+// when the meta key is incomplete, a SnapshotVersionError when it was written
+// by a newer version.
+func (p *RedisIncrementalPersistence) Load(ctx context.Context) (*TemplateMiner, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	meta, err := p.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := p.rdb.HGetAll(ctx, p.clustersKey(meta.Generation)).Result()
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	idToCluster := make(map[int64]*LogCluster, len(fields))
+	for _, field := range fields {
+		cluster := &LogCluster{}
+		if err := json.Unmarshal([]byte(field), cluster); err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+		idToCluster[cluster.id] = cluster
+	}
+	entries, err := p.rdb.LRange(ctx, p.changeLogKey(meta.Generation), 0, -1).Result()
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	for _, b := range entries {
+		entry := clusterChangeEntry{}
+		if err := json.Unmarshal([]byte(b), &entry); err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+		if entry.Evicted || entry.Cluster == nil {
+			delete(idToCluster, entry.ID)
+			continue
+		}
+		idToCluster[entry.ID] = entry.Cluster
+	}
+
+	tokenizer, err := tokenizerFromMarshalStruct(meta.Tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	clusters := make([]*LogCluster, 0, len(idToCluster))
+	saved := make(map[int64]clusterVersion, len(idToCluster))
+	for id, cluster := range idToCluster {
+		clusters = append(clusters, cluster)
+		saved[id] = versionOf(cluster)
+	}
+	position := make(map[int64]int, len(meta.Order))
+	for i, id := range meta.Order {
+		position[id] = i
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return position[clusters[i].id] < position[clusters[j].id]
+	})
+
+	drain := newDrainWithConfig(drainConfig{
+		Similarity:      meta.Sim,
+		Depth:           meta.MaxDepth,
+		MaxChildren:     meta.MaxChildren,
+		MaxCluster:      meta.MaxClusters,
+		ClusterIDOffset: meta.ClusterIDOffset,
+		ClusterIDStride: meta.ClusterIDStride,
+		EvictionPolicy:  meta.EvictionPolicy,
+		HistorySize:     meta.HistorySize,
+		Tokenizer:       tokenizer,
+	})
+	drain.clusterCounter = meta.ClusterCounter
+	drain.restoreClusters(clusters)
+
+	p.generation = meta.Generation
+	p.saved = saved
+	p.logLength = len(entries)
+	return &TemplateMiner{
+		drain:  drain,
+		masker: meta.Masker,
+	}, nil
+}
+
+func (p *RedisIncrementalPersistence) saveMeta(ctx context.Context, template *TemplateMiner,
+	clusters []*LogCluster, generation, counter int64) error {
+	drain := template.drain
+	order := make([]int64, 0, len(clusters))
+	for _, cluster := range clusters {
+		order = append(order, cluster.id)
+	}
+	b, err := json.Marshal(&redisIncrementalMeta{
+		FormatVersion:   redis_incremental_format_version,
+		Generation:      generation,
+		Masker:          template.masker,
+		MaxDepth:        drain.maxDepth,
+		Sim:             drain.sim,
+		MaxChildren:     drain.maxChildren,
+		MaxClusters:     drain.maxClusters,
+		ClusterIDOffset: drain.clusterIDOffset,
+		ClusterIDStride: drain.clusterIDStride,
+		ClusterCounter:  counter,
+		EvictionPolicy:  drain.evictionPolicy,
+		HistorySize:     drain.historySize,
+		Tokenizer:       drain.tokenizer.marshalStruct(),
+		Order:           order,
+	})
+	if err != nil {
+		return errInternal(err)
+	}
+	if err := p.rdb.Set(ctx, p.metaKey(), string(b), 0).Err(); err != nil {
+		return errInternal(err)
+	}
+	return nil
+}
+
+func (p *RedisIncrementalPersistence) loadMeta(ctx context.Context) (*redisIncrementalMeta, error) {
+	val, err := p.rdb.Get(ctx, p.metaKey()).Result()
+	if err == redis.Nil {
+		return nil, errSnapshotNotFound(err)
+	}
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	meta := redisIncrementalMeta{}
+	if err := json.Unmarshal([]byte(val), &meta); err != nil {
+		return nil, errSnapshotCorrupted(err)
+	}
+	if err := meta.check(); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// check verifies that the meta is complete, a miner restored from an
+// incomplete meta would panic.
+func (meta *redisIncrementalMeta) check() error {
+	if meta.FormatVersion > redis_incremental_format_version {
+		return errSnapshotVersionRaw(fmt.Sprintf(
+			"incremental format version %d is newer than %d, upgrade the library",
+			meta.FormatVersion, redis_incremental_format_version))
+	}
+	if meta.FormatVersion != redis_incremental_format_version {
+		return errSnapshotCorruptedRaw(fmt.Sprintf("unsupported incremental format version %d", meta.FormatVersion))
+	}
+	if meta.Masker == nil {
+		return errSnapshotCorruptedRaw("incremental meta without masker")
+	}
+	if meta.Generation < 1 || meta.MaxDepth < 1 || meta.MaxChildren < 1 || meta.MaxClusters < 1 ||
+		meta.ClusterIDStride < 1 {
+		return errSnapshotCorruptedRaw("incremental meta without drain config")
+	}
+	return nil
+}
+
+func (p *RedisIncrementalPersistence) metaKey() string {
+	return p.serviceKey + ":meta"
+}
+
+func (p *RedisIncrementalPersistence) clustersKey(generation int64) string {
+	return fmt.Sprintf("%s:clusters:%d", p.serviceKey, generation)
+}
+
+func (p *RedisIncrementalPersistence) changeLogKey(generation int64) string {
+	return fmt.Sprintf("%s:changelog:%d", p.serviceKey, generation)
+}
+
+func versionOf(cluster *LogCluster) clusterVersion {
+	return clusterVersion{
+		size:     cluster.size,
+		lastSeen: cluster.lastSeen.UnixNano(),
+		template: cluster.getTemplate(),
+		name:     cluster.name,
+		pinned:   cluster.pinned,
+		locked:   cluster.locked,
+	}
+}
+
+type redisIncrementalConfig struct {
+	CompactionThreshold int
+}
+
+func newRedisIncrementalConfig(options []redisIncrementalOption) redisIncrementalConfig {
+	conf := redisIncrementalConfig{
+		CompactionThreshold: default_compaction_threshold,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	return conf
+}
+
+// WithCompactionThreshold sets the number of change log entries after which
+// the next save writes a full snapshot, 10000 by default.
+func WithCompactionThreshold(entries int) redisIncrementalOption {
+	return redisIncrementalOptionFunc(func(conf redisIncrementalConfig) redisIncrementalConfig {
+		conf.CompactionThreshold = entries
+		return conf
+	})
+}
+
+type redisIncrementalOption interface {
+	apply(redisIncrementalConfig) redisIncrementalConfig
+}
+
+type redisIncrementalOptionFunc func(redisIncrementalConfig) redisIncrementalConfig
+
+func (o redisIncrementalOptionFunc) apply(conf redisIncrementalConfig) redisIncrementalConfig {
+	return o(conf)
+}
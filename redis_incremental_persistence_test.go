@@ -0,0 +1,177 @@
+package loggingdrain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func clusterStates(miner *TemplateMiner) []string {
+	states := []string{}
+	for _, cluster := range miner.Clusters(CLUSTER_SORT_BY_ID) {
+		states = append(states, fmt.Sprintf("%d %d %s", cluster.ID(), cluster.Size(), cluster.Template()))
+	}
+	return states
+}
+
+func TestRedisIncrementalPersistence(t *testing.T) {
+	t.Run("test save and load", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test")
+		miner := newTestMiner(t, 500)
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, rdb.hashes["test:clusters:1"], len(miner.Clusters(CLUSTER_SORT_BY_ID)))
+
+		loaded, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterStates(miner), clusterStates(loaded))
+		for _, log := range testData[:500] {
+			assert.Equal(t, miner.Match(log).ID(), loaded.Match(log).ID())
+		}
+		response := loaded.AddLogMessage(testData[0])
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NONE, response.ChangeType)
+	})
+	t.Run("test incremental save", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test")
+		miner := newTestMiner(t, 100)
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		snapshot := rdb.hashes["test:clusters:1"]
+
+		miner.AddLogMessage(testData[0])
+		miner.AddLogMessage("a brand new message")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, snapshot, rdb.hashes["test:clusters:1"])
+		assert.Len(t, rdb.lists["test:changelog:1"], 2)
+
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, rdb.lists["test:changelog:1"], 2)
+
+		loaded, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterStates(miner), clusterStates(loaded))
+		assert.Equal(t, miner.AddLogMessage("another new message").Cluster.ID(),
+			loaded.AddLogMessage("another new message").Cluster.ID())
+	})
+	t.Run("test evicted clusters", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test")
+		miner, _ := NewTemplateMiner(WithDrainMaxCluster(2))
+		miner.AddLogMessage("a")
+		miner.AddLogMessage("b b")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("c c c")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{
+			`{"ID":3,"Cluster":` + string(mustMarshal(t, miner.GetCluster(3))) + `}`,
+			`{"ID":1,"Evicted":true}`,
+		}, rdb.lists["test:changelog:1"])
+
+		loaded, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"2 1 b b", "3 1 c c c"}, clusterStates(loaded))
+	})
+	t.Run("test compaction", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test", WithCompactionThreshold(2))
+		miner := newTestMiner(t, 10)
+		for i := 0; i < 3; i++ {
+			miner.AddLogMessage(fmt.Sprintf("message %c", 'a'+i))
+			if err := p.Save(context.Background(), miner); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Len(t, rdb.lists["test:changelog:1"], 2)
+		miner.AddLogMessage("one more message")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, rdb.hashes, "test:clusters:1")
+		assert.NotContains(t, rdb.lists, "test:changelog:1")
+		assert.Len(t, rdb.hashes["test:clusters:2"], len(miner.Clusters(CLUSTER_SORT_BY_ID)))
+
+		loaded, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterStates(miner), clusterStates(loaded))
+	})
+	t.Run("test cache order is restored", func(t *testing.T) {
+		now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+		clock := func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test")
+		miner, _ := NewTemplateMiner(WithDrainMaxCluster(3), WithClock(clock))
+		miner.AddLogMessage("user alice")
+		miner.AddLogMessage("disk full")
+		miner.AddLogMessage("cpu hot now")
+		// seen last but not used, the least recently used cluster still
+		miner.AddLogMessage("user alice")
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("a new message")
+		loaded.AddLogMessage("a new message")
+		assert.Equal(t, clusterStates(miner), clusterStates(loaded))
+		assert.Nil(t, loaded.GetCluster(1))
+	})
+	t.Run("test incomplete meta", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		p := newRedisIncrementalPersistence(rdb, "test")
+		if err := p.Save(context.Background(), newTestMiner(t, 10)); err != nil {
+			t.Fatal(err)
+		}
+		meta := rdb.data["test:meta"]
+		rdb.data["test:meta"] = strings.Replace(meta, `"FormatVersion":1`, `"FormatVersion":99`, 1)
+		_, err := newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+		assert.True(t, errorIs(err, snapshotVersionError))
+
+		for _, data := range []string{`{"Generation":1}`, `{"FormatVersion":1,"Generation":1}`, strings.Replace(meta, `"Masker":`, `"Other":`, 1)} {
+			rdb.data["test:meta"] = data
+			_, err = newRedisIncrementalPersistence(rdb, "test").Load(context.Background())
+			assert.True(t, errorIs(err, snapshotCorruptedError), data)
+		}
+	})
+	t.Run("test missing snapshot", func(t *testing.T) {
+		p := newRedisIncrementalPersistence(newFakeRedisClient(), "test")
+		_, err := p.Load(context.Background())
+		assert.True(t, errorIs(err, snapshotNotFoundError))
+	})
+}
+
+func mustMarshal(t *testing.T, cluster *LogCluster) []byte {
+	b, err := cluster.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -14,6 +14,7 @@ type RedisPersistence struct {
 	db         int
 	serviceKey string
 	rdb        RedisClient
+	encoding   SnapshotEncoding
 }
 
 // RedisClient for mock testing
@@ -25,7 +26,18 @@ type RedisClient interface {
 
 var _ RedisClient = &redis.Client{}
 
-func NewRedisPersistence(addr, password string, db int, serviceKey string) *RedisPersistence {
+// RedisPubSubClient is a RedisClient which can publish, required by the
+// SyncTransport of a RedisPersistence.
+type RedisPubSubClient interface {
+	RedisClient
+	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
+}
+
+var _ RedisPubSubClient = &redis.Client{}
+
+func NewRedisPersistence(addr, password string, db int, serviceKey string,
+	options ...redisPersistenceOption) *RedisPersistence {
+	conf := newRedisPersistenceConfig(options)
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
@@ -37,15 +49,16 @@ func NewRedisPersistence(addr, password string, db int, serviceKey string) *Redi
 		db:         db,
 		serviceKey: serviceKey,
 		rdb:        rdb,
+		encoding:   conf.Encoding,
 	}
 }
 
-var _ persistenceHandler = &RedisPersistence{}
+var _ PersistenceHandler = &RedisPersistence{}
 
 func (p *RedisPersistence) Save(ctx context.Context, template *TemplateMiner) error {
-	b, err := json.Marshal(template)
+	b, err := encodeSnapshot(template, p.encoding)
 	if err != nil {
-		return errInternal(err)
+		return err
 	}
 	if err := p.rdb.Set(ctx, p.serviceKey, string(b), 0).Err(); err != nil {
 		return errInternal(err)
@@ -53,18 +66,91 @@ func (p *RedisPersistence) Save(ctx context.Context, template *TemplateMiner) er
 	return nil
 }
 
+// Load loads the snapshot, whatever its encoding.
 func (p *RedisPersistence) Load(ctx context.Context) (*TemplateMiner, error) {
 	val, err := p.rdb.Get(ctx, p.serviceKey).Result()
+	if err == redis.Nil {
+		return nil, errSnapshotNotFound(err)
+	}
 	if err != nil {
 		return nil, errInternal(err)
 	}
-	miner := TemplateMiner{}
-	if err := json.Unmarshal([]byte(val), &miner); err != nil {
-		return nil, errInternal(err)
+	return decodeSnapshot([]byte(val))
+}
+
+// SaveSharded saves all shards of miner under the service key, always
+// encoded in JSON.
+func (p *RedisPersistence) SaveSharded(ctx context.Context, miner *ShardedTemplateMiner) error {
+	return p.save(ctx, miner)
+}
+
+// LoadSharded loads a miner saved with SaveSharded.
+func (p *RedisPersistence) LoadSharded(ctx context.Context) (*ShardedTemplateMiner, error) {
+	miner := ShardedTemplateMiner{}
+	if err := p.load(ctx, &miner); err != nil {
+		return nil, err
 	}
 	return &miner, nil
 }
 
+func (p *RedisPersistence) save(ctx context.Context, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errInternal(err)
+	}
+	if err := p.rdb.Set(ctx, p.serviceKey, string(b), 0).Err(); err != nil {
+		return errInternal(err)
+	}
+	return nil
+}
+
+func (p *RedisPersistence) load(ctx context.Context, v interface{}) error {
+	val, err := p.rdb.Get(ctx, p.serviceKey).Result()
+	if err == redis.Nil {
+		return errSnapshotNotFound(err)
+	}
+	if err != nil {
+		return errInternal(err)
+	}
+	if err := json.Unmarshal([]byte(val), v); err != nil {
+		return errSnapshotUnmarshal(err)
+	}
+	return nil
+}
+
 func (p *RedisPersistence) Subscribe(ctx context.Context) *redis.PubSub {
 	return p.rdb.Subscribe(ctx, p.serviceKey)
 }
+
+type redisPersistenceConfig struct {
+	Encoding SnapshotEncoding
+}
+
+func newRedisPersistenceConfig(options []redisPersistenceOption) redisPersistenceConfig {
+	conf := redisPersistenceConfig{
+		Encoding: SNAPSHOT_ENCODING_JSON,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	return conf
+}
+
+// WithRedisSnapshotEncoding sets the encoding of the snapshots, JSON by
+// default. The snapshots of every encoding are loaded.
+func WithRedisSnapshotEncoding(encoding SnapshotEncoding) redisPersistenceOption {
+	return redisPersistenceOptionFunc(func(conf redisPersistenceConfig) redisPersistenceConfig {
+		conf.Encoding = encoding
+		return conf
+	})
+}
+
+type redisPersistenceOption interface {
+	apply(redisPersistenceConfig) redisPersistenceConfig
+}
+
+type redisPersistenceOptionFunc func(redisPersistenceConfig) redisPersistenceConfig
+
+func (o redisPersistenceOptionFunc) apply(conf redisPersistenceConfig) redisPersistenceConfig {
+	return o(conf)
+}
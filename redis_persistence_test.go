@@ -0,0 +1,179 @@
+package loggingdrain
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRedisClient struct {
+	mu        sync.Mutex
+	data      map[string]string
+	hashes    map[string]map[string]string
+	lists     map[string][]string
+	published map[string][]string
+}
+
+var _ RedisIncrementalClient = &fakeRedisClient{}
+var _ RedisPubSubClient = &fakeRedisClient{}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{
+		data:      map[string]string{},
+		hashes:    map[string]map[string]string{},
+		lists:     map[string][]string{},
+		published: map[string][]string{},
+	}
+}
+
+func (c *fakeRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewStatusCmd(ctx)
+	c.data[key] = fmt.Sprint(value)
+	cmd.SetVal("OK")
+	return cmd
+}
+
+func (c *fakeRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewStringCmd(ctx)
+	val, ok := c.data[key]
+	if !ok {
+		cmd.SetErr(redis.Nil)
+		return cmd
+	}
+	cmd.SetVal(val)
+	return cmd
+}
+
+func (c *fakeRedisClient) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return nil
+}
+
+func (c *fakeRedisClient) Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	if b, ok := message.([]byte); ok {
+		message = string(b)
+	}
+	c.published[channel] = append(c.published[channel], fmt.Sprint(message))
+	cmd.SetVal(0)
+	return cmd
+}
+
+func (c *fakeRedisClient) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	hash, ok := c.hashes[key]
+	if !ok {
+		hash = map[string]string{}
+		c.hashes[key] = hash
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		hash[fmt.Sprint(values[i])] = fmt.Sprint(values[i+1])
+	}
+	cmd.SetVal(int64(len(values) / 2))
+	return cmd
+}
+
+func (c *fakeRedisClient) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewMapStringStringCmd(ctx)
+	hash := map[string]string{}
+	for field, value := range c.hashes[key] {
+		hash[field] = value
+	}
+	cmd.SetVal(hash)
+	return cmd
+}
+
+func (c *fakeRedisClient) RPush(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	for _, value := range values {
+		c.lists[key] = append(c.lists[key], fmt.Sprint(value))
+	}
+	cmd.SetVal(int64(len(c.lists[key])))
+	return cmd
+}
+
+func (c *fakeRedisClient) LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewStringSliceCmd(ctx)
+	list := c.lists[key]
+	if stop < 0 || stop >= int64(len(list)) {
+		stop = int64(len(list)) - 1
+	}
+	if start > stop {
+		cmd.SetVal([]string{})
+		return cmd
+	}
+	cmd.SetVal(append([]string{}, list[start:stop+1]...))
+	return cmd
+}
+
+func (c *fakeRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := redis.NewIntCmd(ctx)
+	deleted := int64(0)
+	for _, key := range keys {
+		_, isString := c.data[key]
+		_, isHash := c.hashes[key]
+		_, isList := c.lists[key]
+		if isString || isHash || isList {
+			deleted += 1
+		}
+		delete(c.data, key)
+		delete(c.hashes, key)
+		delete(c.lists, key)
+	}
+	cmd.SetVal(deleted)
+	return cmd
+}
+
+func newTestRedisPersistence(rdb RedisClient) *RedisPersistence {
+	return &RedisPersistence{
+		serviceKey: "test",
+		rdb:        rdb,
+	}
+}
+
+func TestRedisPersistence(t *testing.T) {
+	t.Run("test save and load", func(t *testing.T) {
+		p := newTestRedisPersistence(newFakeRedisClient())
+		miner, _ := NewTemplateMiner(WithMaskInsturction(`\d+`, "NUM"))
+		for _, log := range testData[:100] {
+			miner.AddLogMessage(log)
+		}
+		if err := p.Save(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := p.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.Status(), loaded.Status())
+		for _, log := range testData[:100] {
+			assert.Equal(t, miner.Match(log).id, loaded.Match(log).id)
+		}
+	})
+	t.Run("test snapshot of a newer version", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		rdb.Set(context.Background(), "test", `{"FormatVersion":99}`, 0)
+		_, err := newTestRedisPersistence(rdb).Load(context.Background())
+		assert.True(t, errorIs(err, snapshotVersionError))
+	})
+}
@@ -0,0 +1,92 @@
+package loggingdrain
+
+import (
+	"fmt"
+)
+
+// SeedTemplate is a known template preloaded in a miner.
+type SeedTemplate struct {
+	// ID is the fixed id of the cluster, the miner assigns one when zero.
+	ID int64
+	// Template is the masked template, tokens separated by spaces and
+	// parameters replaced by the wildcard [*].
+	Template string
+	Name     string
+	// Pinned seeds are never evicted.
+	Pinned bool
+}
+
+// WithSeedTemplates preloads the miner with templates, see SeedTemplates. A
+// miner restored by WithPersistence is seeded as well, the seeds it already
+// holds are left unchanged. A ShardedTemplateMiner adds every seed to the
+// shard of its token count, the fixed ids must belong to that shard.
+func WithSeedTemplates(seeds ...SeedTemplate) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Seeds = append(conf.Seeds, seeds...)
+		return conf
+	})
+}
+
+// SeedTemplates adds locked clusters with the templates of seeds. The
+// template of a locked cluster is never generalized: the log messages which
+// do not fit it create new clusters alongside.
+//
+// A seed matching the template of a cluster of the miner locks that cluster
+// and keeps its statistics. A ClusterIDConflictError is returned when the id
+// of a seed belongs to another template, or its template to another id.
+func (miner *TemplateMiner) SeedTemplates(seeds ...SeedTemplate) error {
+	for _, seed := range seeds {
+		cluster, updateType, err := miner.drain.seedCluster(seed)
+		if err != nil {
+			return withMessagef(err, "seed %q", seed.Template)
+		}
+		miner.listeners.notify(updateType, cluster)
+	}
+	return nil
+}
+
+func (drain *drain) seedCluster(seed SeedTemplate) (*LogCluster, ClusterUpdateType, error) {
+	tokens := drain.tokenize(seed.Template)
+	if seed.ID < 0 {
+		return nil, CLUSTER_UPDATE_TYPE_NONE, errInternalRaw(fmt.Sprintf("invalid seed id %d", seed.ID))
+	}
+	drain.mu.Lock()
+	cluster, updateType, err := drain.seedClusterLocked(seed, tokens)
+	evicted := drain.takeEvicted()
+	drain.mu.Unlock()
+	drain.notifyEvicted(evicted)
+	return cluster, updateType, err
+}
+
+func (drain *drain) seedClusterLocked(seed SeedTemplate, tokens []string) (*LogCluster, ClusterUpdateType, error) {
+	if cluster := drain.exactCluster(tokens); cluster != nil {
+		if seed.ID != 0 && seed.ID != cluster.id {
+			return nil, CLUSTER_UPDATE_TYPE_NONE, errClusterIDConflictRaw(
+				fmt.Sprintf("the template belongs to cluster %d", cluster.id))
+		}
+		cluster.mu.Lock()
+		cluster.locked = true
+		cluster.pinned = cluster.pinned || seed.Pinned
+		if seed.Name != "" {
+			cluster.name = seed.Name
+		}
+		cluster.mu.Unlock()
+		return cluster, CLUSTER_UPDATE_TYPE_NONE, nil
+	}
+
+	id := seed.ID
+	if id == 0 {
+		id = drain.nextClusterID()
+	} else if other, ok := drain.idToCluster.Peek(id); ok {
+		return nil, CLUSTER_UPDATE_TYPE_NONE, errClusterIDConflictRaw(
+			fmt.Sprintf("id %d belongs to %q", id, other.getTemplate()))
+	}
+	drain.reserveClusterID(id)
+	cluster := newLogCluster(id, tokens)
+	cluster.name = seed.Name
+	cluster.pinned = seed.Pinned
+	cluster.locked = true
+	drain.addSeqToPrefixTree(drain.rootNode, cluster)
+	drain.cacheCluster(id, cluster)
+	return cluster, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, nil
+}
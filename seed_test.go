@@ -0,0 +1,101 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedTemplates(t *testing.T) {
+	seeds := []SeedTemplate{
+		{ID: 100, Template: "user [*] logged in", Name: "login"},
+		{Template: "disk [:NUM:] is full"},
+	}
+	t.Run("test seeded clusters", func(t *testing.T) {
+		miner, err := NewTemplateMiner(
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+			WithSeedTemplates(seeds...),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		login := miner.GetCluster(100)
+		assert.Equal(t, "user [*] logged in", login.Template())
+		assert.Equal(t, "login", login.Name())
+		assert.True(t, login.Locked())
+		assert.Equal(t, int64(0), login.Size())
+
+		response := miner.AddLogMessage("user alice logged in")
+		assert.Same(t, login, response.Cluster)
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NONE, response.ChangeType)
+		assert.Equal(t, int64(1), login.Size())
+
+		disk := miner.AddLogMessage("disk 2 is full").Cluster
+		assert.Equal(t, "disk [:NUM:] is full", disk.Template())
+		assert.True(t, disk.Locked())
+
+		// learned clusters get ids after the seeds
+		response = miner.AddLogMessage("connection reset by peer")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, response.ChangeType)
+		assert.Equal(t, int64(102), response.Cluster.ID())
+		assert.Nil(t, miner.CheckConsistency())
+	})
+	t.Run("test locked templates are not generalized", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithSeedTemplates(seeds...))
+		response := miner.AddLogMessage("user alice logged out")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, response.ChangeType)
+		assert.Equal(t, "user alice logged out", response.Cluster.Template())
+		assert.Equal(t, "user [*] logged in", miner.GetCluster(100).Template())
+
+		// the learned cluster is generalized as usual
+		response = miner.AddLogMessage("user bob logged out")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, response.ChangeType)
+		assert.Equal(t, "user [*] logged out", response.Cluster.Template())
+
+		_, err := miner.MergeClusters(100, response.Cluster.ID())
+		assert.True(t, errorIs(err, templateMismatchError))
+	})
+	t.Run("test seed conflicts", func(t *testing.T) {
+		miner, _ := NewTemplateMiner()
+		learned := miner.AddLogMessage("user alice logged in").Cluster
+		err := miner.SeedTemplates(SeedTemplate{ID: learned.ID(), Template: "disk is full"})
+		assert.True(t, errorIs(err, clusterIDConflictError))
+		err = miner.SeedTemplates(SeedTemplate{ID: 7, Template: "user alice logged in"})
+		assert.True(t, errorIs(err, clusterIDConflictError))
+
+		// a seed of a known template locks the cluster
+		if err := miner.SeedTemplates(SeedTemplate{Template: "user alice logged in", Name: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, learned.Locked())
+		assert.Equal(t, "alice", learned.Name())
+		assert.Equal(t, int64(1), learned.Size())
+	})
+	t.Run("test seeds are persisted", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithSeedTemplates(seeds...))
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, loaded.GetCluster(100).Locked())
+		assert.Equal(t, clusterStates(miner), clusterStates(&loaded))
+
+		// seeding the restored miner again changes nothing
+		if err := loaded.SeedTemplates(seeds...); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterStates(miner), clusterStates(&loaded))
+	})
+	t.Run("test sharded miner", func(t *testing.T) {
+		miner, err := NewShardedTemplateMiner(2, WithSeedTemplates(SeedTemplate{ID: 1, Template: "user [*] logged in"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "user [*] logged in", miner.GetCluster(1).Template())
+
+		_, err = NewShardedTemplateMiner(2, WithSeedTemplates(SeedTemplate{ID: 2, Template: "user [*] logged in"}))
+		assert.True(t, errorIs(err, clusterIDConflictError))
+	})
+}
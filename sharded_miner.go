@@ -0,0 +1,168 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+)
+
+// ShardedTemplateMiner partitions log messages across several independent
+// drain trees so that messages can be added from many goroutines without
+// contending on a single tree lock.
+//
+// Messages are routed by their token count with AddLogMessage and Match, or
+// by a caller provided key (e.g. the service name) with AddLogMessageWithKey
+// and MatchWithKey. A message has to be matched the same way it was added.
+//
+// Every shard assigns ids from its own residue class, cluster ids are
+// therefore unique across all shards.
+type ShardedTemplateMiner struct {
+	masker *logMasker
+	shards []*drain
+}
+
+type shardedTemplateMinerMarshalStruct struct {
+	snapshotEnvelope
+	Masker *logMasker
+	Shards []*drain
+}
+
+func (miner *ShardedTemplateMiner) MarshalJSON() ([]byte, error) {
+	envelope, err := newSnapshotEnvelope(miner.shards[0].now(), miner.masker, miner.shards...)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(shardedTemplateMinerMarshalStruct{
+		snapshotEnvelope: envelope,
+		Masker:           miner.masker,
+		Shards:           miner.shards,
+	})
+}
+
+// UnmarshalJSON upgrades the snapshots of older format versions, a
+// SnapshotVersionError is returned for the snapshots of a newer version.
+func (miner *ShardedTemplateMiner) UnmarshalJSON(data []byte) error {
+	data, migrated, err := migrateSnapshot(data)
+	if err != nil {
+		return err
+	}
+	var marshalStruct shardedTemplateMinerMarshalStruct
+	err = json.Unmarshal(data, &marshalStruct)
+	if err != nil {
+		return err
+	}
+	if err := marshalStruct.check(migrated, marshalStruct.Masker, marshalStruct.Shards...); err != nil {
+		return err
+	}
+	miner.masker = marshalStruct.Masker
+	miner.shards = marshalStruct.Shards
+	return nil
+}
+
+// NewShardedTemplateMiner creates a miner with shardCount drain trees, all
+// configured with options. A shardCount lower than one uses one shard per
+// available CPU.
+//
+// The limits of the options apply to each shard: WithDrainMaxCluster bounds
+// the clusters of every shard, so the miner holds up to shardCount times as
+// many clusters.
+func NewShardedTemplateMiner(shardCount int, options ...minerOption) (*ShardedTemplateMiner, error) {
+	if shardCount < 1 {
+		shardCount = runtime.GOMAXPROCS(0)
+	}
+	c := newTemplateMinerConfig(options)
+	masker, err := newLogMaskerWithConfig(c.Mask)
+	if err != nil {
+		return nil, err
+	}
+	tokenizer, err := c.Drain.Tokenizer.resolve()
+	if err != nil {
+		return nil, err
+	}
+	c.Drain.Tokenizer = tokenizer
+	shards := make([]*drain, 0, shardCount)
+	for i := 0; i < shardCount; i++ {
+		conf := withClusterIDSpace(int64(i), int64(shardCount)).apply(c.Drain)
+		shards = append(shards, newDrainWithConfig(conf))
+	}
+	for _, seed := range c.Seeds {
+		// a seed goes to the shard of its token count, which must own its id
+		i := len(shards[0].tokenize(seed.Template)) % shardCount
+		if seed.ID != 0 && (seed.ID-1)%int64(shardCount) != int64(i) {
+			return nil, errClusterIDConflictRaw(fmt.Sprintf(
+				"seed %q with id %d does not belong to shard %d", seed.Template, seed.ID, i))
+		}
+		if _, _, err := shards[i].seedCluster(seed); err != nil {
+			return nil, withMessagef(err, "seed %q", seed.Template)
+		}
+	}
+	return &ShardedTemplateMiner{
+		masker: masker,
+		shards: shards,
+	}, nil
+}
+
+func (miner *ShardedTemplateMiner) ShardCount() int {
+	return len(miner.shards)
+}
+
+// AddLogMessage adds message to the shard of its token count.
+func (miner *ShardedTemplateMiner) AddLogMessage(message string) *LogMessageResponse {
+	tokens := miner.tokenize(message)
+	return miner.addLogTokens(miner.shards[len(tokens)%len(miner.shards)], tokens)
+}
+
+// AddLogMessageWithKey adds message to the shard of key.
+func (miner *ShardedTemplateMiner) AddLogMessageWithKey(key, message string) *LogMessageResponse {
+	tokens := miner.tokenize(message)
+	return miner.addLogTokens(miner.keyShard(key), tokens)
+}
+
+// tokenize masks message and splits it with the tokenizer the shards share.
+func (miner *ShardedTemplateMiner) tokenize(message string) []string {
+	return miner.shards[0].tokenize(miner.masker.mask(message))
+}
+
+func (miner *ShardedTemplateMiner) addLogTokens(shard *drain, tokens []string) *LogMessageResponse {
+	response := shard.addLogTokens(tokens)
+	response.ClusterCount = miner.clusterCount()
+	return response
+}
+
+// Match matches message against the shard of its token count.
+func (miner *ShardedTemplateMiner) Match(message string) *LogCluster {
+	tokens := miner.tokenize(message)
+	cluster, _, _ := miner.shards[len(tokens)%len(miner.shards)].matchTokens(tokens, SEARCH_STRATEGY_NEVER, 1)
+	return cluster
+}
+
+// MatchWithKey matches message against the shard of key.
+func (miner *ShardedTemplateMiner) MatchWithKey(key, message string) *LogCluster {
+	tokens := miner.tokenize(message)
+	cluster, _, _ := miner.keyShard(key).matchTokens(tokens, SEARCH_STRATEGY_NEVER, 1)
+	return cluster
+}
+
+// Status returns the templates of all shards, shard by shard.
+func (miner *ShardedTemplateMiner) Status() string {
+	templates := []string{}
+	for _, shard := range miner.shards {
+		templates = append(templates, shard.templates()...)
+	}
+	return formatStatus(templates)
+}
+
+func (miner *ShardedTemplateMiner) keyShard(key string) *drain {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return miner.shards[h.Sum32()%uint32(len(miner.shards))]
+}
+
+func (miner *ShardedTemplateMiner) clusterCount() int {
+	count := 0
+	for _, shard := range miner.shards {
+		count += shard.clusterCount()
+	}
+	return count
+}
@@ -0,0 +1,94 @@
+package loggingdrain
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkBuildShardedTree(b *testing.B) {
+	miner, _ := NewShardedTemplateMiner(0)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			miner.AddLogMessage(testData[i%len(testData)])
+			i++
+		}
+	})
+}
+
+func TestShardedTemplateMiner(t *testing.T) {
+	t.Run("test unique cluster ids", func(t *testing.T) {
+		miner, _ := NewShardedTemplateMiner(4)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(offset int) {
+				defer wg.Done()
+				for j := offset; j < len(testData); j += 4 {
+					miner.AddLogMessage(testData[j])
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		ids := map[int64]string{}
+		for _, log := range testData {
+			cluster := miner.Match(log)
+			if cluster == nil {
+				continue
+			}
+			if template, ok := ids[cluster.id]; ok {
+				assert.Equal(t, template, cluster.getTemplate())
+			}
+			ids[cluster.id] = cluster.getTemplate()
+			shard := miner.shards[len(getStringTokens(log))%4]
+			assert.Equal(t, int64(len(getStringTokens(log))%4), (cluster.id-1)%4)
+			assert.True(t, shard.idToCluster.Contains(cluster.id))
+		}
+		assert.NotEmpty(t, ids)
+	})
+	t.Run("test merged status", func(t *testing.T) {
+		miner, _ := NewShardedTemplateMiner(2)
+		miner.AddLogMessage("a b")
+		miner.AddLogMessage("a b c")
+		resp := miner.AddLogMessage("a b d")
+		assert.Equal(t, 2, resp.ClusterCount)
+		assert.Equal(t, "a b [*]", resp.TemplateMined)
+		status := miner.Status()
+		assert.True(t, strings.HasPrefix(status, "cluster count 2\n"))
+		assert.Contains(t, status, "a b\n")
+		assert.Contains(t, status, "a b [*]\n")
+	})
+	t.Run("test key partition", func(t *testing.T) {
+		miner, _ := NewShardedTemplateMiner(8)
+		miner.AddLogMessageWithKey("api", "request served in 10 ms")
+		resp := miner.AddLogMessageWithKey("api", "request served in 12 ms")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, resp.ChangeType)
+		assert.Equal(t, resp.Cluster, miner.MatchWithKey("api", "request served in 99 ms"))
+		assert.Equal(t, miner.keyShard("api"), miner.keyShard("api"))
+	})
+	t.Run("test save and load", func(t *testing.T) {
+		miner, _ := NewShardedTemplateMiner(3, WithMaskInsturction(`\d+`, "NUM"))
+		for _, log := range testData[:200] {
+			miner.AddLogMessage(log)
+		}
+		p := newTestRedisPersistence(newFakeRedisClient())
+		if err := p.SaveSharded(context.Background(), miner); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := p.LoadSharded(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, loaded.ShardCount())
+		assert.Equal(t, miner.Status(), loaded.Status())
+
+		before := miner.AddLogMessage("a brand new message")
+		after := loaded.AddLogMessage("a brand new message")
+		assert.Equal(t, before.Cluster.id, after.Cluster.id)
+	})
+}
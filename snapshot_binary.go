@@ -0,0 +1,437 @@
+package loggingdrain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type SnapshotEncoding int
+
+const (
+	// SNAPSHOT_ENCODING_JSON encodes the snapshots with MarshalJSON.
+	SNAPSHOT_ENCODING_JSON SnapshotEncoding = iota
+	// SNAPSHOT_ENCODING_BINARY encodes the snapshots with MarshalBinary.
+	SNAPSHOT_ENCODING_BINARY
+)
+
+const (
+	snapshot_binary_magic   = "LDRN"
+	snapshot_binary_version = 1
+)
+
+// cluster flags of the binary snapshots.
+const (
+	binary_cluster_pinned = 1 << iota
+	binary_cluster_locked
+)
+
+// MarshalBinary encodes the miner in a compact binary format.
+//
+// Every distinct token is written once in a string table and the templates
+// refer to it by index, integers are varints. The prefix tree is not
+// written, UnmarshalBinary rebuilds it from the clusters.
+func (miner *TemplateMiner) MarshalBinary() ([]byte, error) {
+	clusters, counter := miner.drain.snapshotClusters()
+	w := binaryWriter{buf: make([]byte, 0, 64*len(clusters)+64)}
+	w.buf = append(w.buf, snapshot_binary_magic...)
+	w.uvarint(snapshot_binary_version)
+
+	masker := miner.masker
+	w.string(masker.prefix)
+	w.string(masker.suffix)
+	w.uvarint(uint64(len(masker.instructions)))
+	for _, ins := range masker.instructions {
+		w.string(string(ins.preset))
+		if ins.preset == "" {
+			w.string(ins.maskWith)
+			w.string(ins.pattern)
+			w.string(ins.maskerName)
+		}
+		w.varint(int64(ins.priority))
+	}
+
+	drain := miner.drain
+	w.uvarint(uint64(drain.maxDepth))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, math.Float32bits(drain.sim))
+	w.uvarint(uint64(drain.maxChildren))
+	w.uvarint(uint64(drain.maxClusters))
+	w.varint(drain.clusterIDOffset)
+	w.varint(drain.clusterIDStride)
+	w.uvarint(uint64(drain.evictionPolicy))
+	w.varint(int64(drain.historySize))
+	w.string(drain.tokenizer.name)
+	w.string(drain.tokenizer.extraDelimiters)
+	w.string(drain.tokenizer.quotes)
+	w.bool(drain.tokenizer.keyValue)
+	w.varint(counter)
+
+	tokenIndex := map[string]uint64{}
+	tokens := []string{}
+	index := func(templateTokens []string) {
+		for _, token := range templateTokens {
+			if _, ok := tokenIndex[token]; !ok {
+				tokenIndex[token] = uint64(len(tokens))
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	for _, cluster := range clusters {
+		index(cluster.logTemplateTokens)
+		for _, change := range cluster.history {
+			index(historyTokens(change.PreviousTemplate))
+			index(historyTokens(change.Template))
+			index(historyTokens(change.Message))
+		}
+	}
+	writeTokens := func(templateTokens []string) {
+		w.uvarint(uint64(len(templateTokens)))
+		for _, token := range templateTokens {
+			w.uvarint(tokenIndex[token])
+		}
+	}
+	w.uvarint(uint64(len(tokens)))
+	for _, token := range tokens {
+		w.string(token)
+	}
+
+	w.uvarint(uint64(len(clusters)))
+	for _, cluster := range clusters {
+		w.varint(cluster.id)
+		w.varint(cluster.size)
+		w.time(cluster.firstSeen)
+		w.time(cluster.lastSeen)
+		flags := uint64(0)
+		if cluster.pinned {
+			flags |= binary_cluster_pinned
+		}
+		if cluster.locked {
+			flags |= binary_cluster_locked
+		}
+		w.uvarint(flags)
+		w.string(cluster.name)
+		w.uvarint(uint64(len(cluster.lineage)))
+		for _, fp := range cluster.lineage {
+			w.string(fp)
+		}
+		w.uvarint(uint64(len(cluster.history)))
+		for _, change := range cluster.history {
+			writeTokens(historyTokens(change.PreviousTemplate))
+			writeTokens(historyTokens(change.Template))
+			writeTokens(historyTokens(change.Message))
+			w.uvarint(uint64(len(change.Wildcards)))
+			for _, position := range change.Wildcards {
+				w.uvarint(uint64(position))
+			}
+			w.time(change.Time)
+		}
+		writeTokens(cluster.logTemplateTokens)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary decodes a miner encoded by MarshalBinary. A
+// SnapshotCorruptedError is returned for invalid data, a SnapshotVersionError
+// for data of a newer format.
+func (miner *TemplateMiner) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(snapshot_binary_magic)) {
+		return errSnapshotCorruptedRaw("not a binary snapshot")
+	}
+	r := binaryReader{data: data, off: len(snapshot_binary_magic)}
+	version := r.uvarint()
+	if r.err == nil && version > snapshot_binary_version {
+		return errSnapshotVersionRaw(fmt.Sprintf(
+			"binary snapshot version %d is newer than %d, upgrade the library", version, snapshot_binary_version))
+	}
+	if r.err == nil && version != snapshot_binary_version {
+		return errSnapshotCorruptedRaw(fmt.Sprintf("unknown binary snapshot version %d", version))
+	}
+
+	masker, err := newLogMasker(r.string(), r.string())
+	if err != nil {
+		return err
+	}
+	instructionCount := r.count()
+	for i := 0; i < instructionCount; i++ {
+		preset := MaskPreset(r.string())
+		var name, pattern, maskerName string
+		if preset == "" {
+			name, pattern, maskerName = r.string(), r.string(), r.string()
+		}
+		priority := int(r.varint())
+		if r.err != nil {
+			break
+		}
+		ins, err := newConfigInstruction(maskInstruction{
+			Pattern:  pattern,
+			MaskWith: name,
+			Priority: priority,
+			Preset:   preset,
+			Masker:   maskerName,
+		})
+		if err != nil {
+			return err
+		}
+		masker.insert(ins)
+	}
+
+	conf := drainConfig{}
+	conf.Depth = int(r.uvarint())
+	conf.Similarity = r.float32()
+	conf.MaxChildren = int(r.uvarint())
+	conf.MaxCluster = int(r.uvarint())
+	conf.ClusterIDOffset = r.varint()
+	conf.ClusterIDStride = r.varint()
+	conf.EvictionPolicy = EvictionPolicy(r.uvarint())
+	conf.HistorySize = int(r.varint())
+	tokenizer, err := tokenizerFromMarshalStruct(&tokenizerMarshalStruct{
+		Name:            r.string(),
+		ExtraDelimiters: r.string(),
+		Quotes:          r.string(),
+		KeyValue:        r.bool(),
+	})
+	if err != nil {
+		return err
+	}
+	conf.Tokenizer = tokenizer
+	counter := r.varint()
+
+	tokens := make([]string, r.count())
+	for i := range tokens {
+		tokens[i] = r.string()
+	}
+
+	clusters := make([]*LogCluster, r.count())
+	for i := range clusters {
+		id := r.varint()
+		size := r.varint()
+		firstSeen := r.time()
+		lastSeen := r.time()
+		flags := r.uvarint()
+		name := r.string()
+		var lineage []string
+		if n := r.count(); n > 0 {
+			lineage = make([]string, n)
+			for j := range lineage {
+				lineage[j] = r.string()
+			}
+		}
+		var history []TemplateChange
+		if n := r.count(); n > 0 {
+			history = make([]TemplateChange, n)
+			for j := range history {
+				history[j] = r.templateChange(tokens)
+			}
+		}
+		templateTokens := r.tokens(tokens)
+		if r.err != nil {
+			break
+		}
+		cluster := newLogCluster(id, templateTokens)
+		cluster.size = size
+		cluster.firstSeen = firstSeen
+		cluster.lastSeen = lastSeen
+		cluster.name = name
+		cluster.lineage = lineage
+		cluster.history = history
+		cluster.pinned = flags&binary_cluster_pinned != 0
+		cluster.locked = flags&binary_cluster_locked != 0
+		clusters[i] = cluster
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.off != len(data) {
+		return errSnapshotCorruptedRaw("trailing data after binary snapshot")
+	}
+
+	drain := newDrainWithConfig(conf)
+	drain.clusterCounter = counter
+	drain.restoreClusters(clusters)
+	miner.drain = drain
+	miner.masker = masker
+	return nil
+}
+
+// encodeSnapshot encodes miner for a persistence handler.
+func encodeSnapshot(miner *TemplateMiner, encoding SnapshotEncoding) ([]byte, error) {
+	if encoding == SNAPSHOT_ENCODING_BINARY {
+		return miner.MarshalBinary()
+	}
+	b, err := json.Marshal(miner)
+	if err != nil {
+		return nil, errInternal(err)
+	}
+	return b, nil
+}
+
+// decodeSnapshot decodes a snapshot written with any encoding.
+func decodeSnapshot(data []byte) (*TemplateMiner, error) {
+	miner := TemplateMiner{}
+	if bytes.HasPrefix(data, []byte(snapshot_binary_magic)) {
+		if err := miner.UnmarshalBinary(data); err != nil {
+			return nil, errSnapshotUnmarshal(err)
+		}
+		return &miner, nil
+	}
+	if err := json.Unmarshal(data, &miner); err != nil {
+		return nil, errSnapshotUnmarshal(err)
+	}
+	return &miner, nil
+}
+
+type binaryWriter struct {
+	buf []byte
+}
+
+func (w *binaryWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *binaryWriter) bool(v bool) {
+	if v {
+		w.uvarint(1)
+	} else {
+		w.uvarint(0)
+	}
+}
+
+func (w *binaryWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// time writes 0 for the zero time, 1 and the unix nanoseconds otherwise.
+func (w *binaryWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.uvarint(0)
+		return
+	}
+	w.uvarint(1)
+	w.varint(t.UnixNano())
+}
+
+// binaryReader keeps the first error, the values read afterwards are zero.
+type binaryReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *binaryReader) fail(message string) {
+	if r.err == nil {
+		r.err = errSnapshotCorruptedRaw(fmt.Sprintf("%s at offset %d", message, r.off))
+	}
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.off:])
+	if n <= 0 {
+		r.fail("invalid uvarint")
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *binaryReader) bool() bool {
+	return r.uvarint() != 0
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.off:])
+	if n <= 0 {
+		r.fail("invalid varint")
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+// count reads a length, which can not exceed the remaining bytes since every
+// element takes at least one byte.
+func (r *binaryReader) count() int {
+	v := r.uvarint()
+	if v > uint64(len(r.data)-r.off) {
+		r.fail("invalid length")
+		return 0
+	}
+	return int(v)
+}
+
+func (r *binaryReader) string() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.data[r.off : r.off+n])
+	r.off += n
+	return s
+}
+
+func (r *binaryReader) float32() float32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data)-r.off < 4 {
+		r.fail("invalid float32")
+		return 0
+	}
+	v := math.Float32frombits(binary.LittleEndian.Uint32(r.data[r.off:]))
+	r.off += 4
+	return v
+}
+
+// tokens reads a list of indexes in the token table.
+func (r *binaryReader) tokens(table []string) []string {
+	tokens := make([]string, r.count())
+	for i := range tokens {
+		index := r.uvarint()
+		if index >= uint64(len(table)) {
+			r.fail("token index out of range")
+			break
+		}
+		tokens[i] = table[index]
+	}
+	return tokens
+}
+
+func (r *binaryReader) templateChange(table []string) TemplateChange {
+	change := TemplateChange{
+		PreviousTemplate: strings.Join(r.tokens(table), " "),
+		Template:         strings.Join(r.tokens(table), " "),
+		Message:          strings.Join(r.tokens(table), " "),
+		Wildcards:        make([]int, r.count()),
+	}
+	for i := range change.Wildcards {
+		change.Wildcards[i] = int(r.uvarint())
+	}
+	change.Time = r.time()
+	return change
+}
+
+func (r *binaryReader) time() time.Time {
+	switch r.uvarint() {
+	case 0:
+		return time.Time{}
+	case 1:
+		return time.Unix(0, r.varint()).UTC()
+	default:
+		r.fail("invalid time")
+		return time.Time{}
+	}
+}
@@ -0,0 +1,119 @@
+package loggingdrain
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func BenchmarkSnapshotEncode(b *testing.B) {
+	miner := newBenchmarkSnapshotMiner()
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, _ := json.Marshal(miner)
+			b.ReportMetric(float64(len(data)), "bytes")
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, _ := miner.MarshalBinary()
+			b.ReportMetric(float64(len(data)), "bytes")
+		}
+	})
+}
+
+func BenchmarkSnapshotDecode(b *testing.B) {
+	miner := newBenchmarkSnapshotMiner()
+	b.Run("json", func(b *testing.B) {
+		data, _ := json.Marshal(miner)
+		for i := 0; i < b.N; i++ {
+			json.Unmarshal(data, &TemplateMiner{})
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		data, _ := miner.MarshalBinary()
+		for i := 0; i < b.N; i++ {
+			(&TemplateMiner{}).UnmarshalBinary(data)
+		}
+	})
+}
+
+func newBenchmarkSnapshotMiner() *TemplateMiner {
+	miner, _ := NewTemplateMiner()
+	for _, log := range testData {
+		miner.AddLogMessage(log)
+	}
+	return miner
+}
+
+func TestSnapshotBinary(t *testing.T) {
+	t.Run("test marshal and unmarshal", func(t *testing.T) {
+		miner := newTestMiner(t, len(testData))
+		data, err := miner.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, clusterStates(miner), clusterStates(&loaded))
+		for _, log := range testData {
+			assert.Equal(t, miner.Match(log).ID(), loaded.Match(log).ID())
+		}
+		assert.Equal(t, miner.AddLogMessage("a brand new message").Cluster.ID(),
+			loaded.AddLogMessage("a brand new message").Cluster.ID())
+
+		jsonData, _ := json.Marshal(miner)
+		assert.Less(t, len(data)*3, len(jsonData))
+	})
+	t.Run("test statistics and config are kept", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		data, err := miner.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.masker, loaded.masker)
+		assert.Equal(t, miner.drain.idToCluster.Values(), loaded.drain.idToCluster.Values())
+		assert.Equal(t, miner.drain.clusterCounter, loaded.drain.clusterCounter)
+		assert.Equal(t, miner.drain.sim, loaded.drain.sim)
+	})
+	t.Run("test corrupted data", func(t *testing.T) {
+		data, _ := newTestMiner(t, 100).MarshalBinary()
+		for _, corrupted := range [][]byte{
+			data[:len(data)/2],
+			append(append([]byte{}, data...), 0),
+			[]byte("garbage"),
+			append([]byte(snapshot_binary_magic), 0),
+		} {
+			err := (&TemplateMiner{}).UnmarshalBinary(corrupted)
+			assert.True(t, errorIs(err, snapshotCorruptedError))
+		}
+		newer := append([]byte(snapshot_binary_magic), 99)
+		err := (&TemplateMiner{}).UnmarshalBinary(newer)
+		assert.True(t, errorIs(err, snapshotVersionError))
+	})
+	t.Run("test persistence handlers", func(t *testing.T) {
+		miner := newTestMiner(t, 200)
+		for _, p := range []PersistenceHandler{
+			NewFilePersistence(t.TempDir(), "miner", WithSnapshotEncoding(SNAPSHOT_ENCODING_BINARY)),
+			NewFilePersistence(t.TempDir(), "miner", WithSnapshotEncoding(SNAPSHOT_ENCODING_BINARY), WithSnapshotCompression()),
+			&RedisPersistence{serviceKey: "test", rdb: newFakeRedisClient(), encoding: SNAPSHOT_ENCODING_BINARY},
+		} {
+			if err := p.Save(context.Background(), miner); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := p.Load(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, clusterStates(miner), clusterStates(loaded))
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package loggingdrain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LibraryVersion is the version of the library written in the snapshots.
+const LibraryVersion = "0.2.0"
+
+// snapshot_format_version is the version of the snapshots written by this
+// library, bumped with a migration whenever a marshal struct changes.
+//
+//	1: the snapshots without envelope
+//	2: the envelope fields are added
+//	3: the prefix tree is rebuilt from the clusters instead of being encoded
+const snapshot_format_version = 3
+
+// snapshotEnvelope is embedded in the marshal structs of the miners.
+type snapshotEnvelope struct {
+	FormatVersion  int
+	LibraryVersion string
+	CreatedAt      time.Time
+	// ConfigHash is the hash of the configuration of the miner, checked on
+	// load to detect snapshots mixing the fields of several formats.
+	ConfigHash string
+}
+
+func newSnapshotEnvelope(createdAt time.Time, masker *logMasker, drains ...*drain) (snapshotEnvelope, error) {
+	hash, err := configHash(masker, drains...)
+	if err != nil {
+		return snapshotEnvelope{}, err
+	}
+	return snapshotEnvelope{
+		FormatVersion:  snapshot_format_version,
+		LibraryVersion: LibraryVersion,
+		CreatedAt:      createdAt.UTC(),
+		ConfigHash:     hash,
+	}, nil
+}
+
+// check verifies a snapshot decoded with the envelope, the config hash of the
+// migrated snapshots is not checked since older versions did not write it.
+func (envelope snapshotEnvelope) check(migrated bool, masker *logMasker, drains ...*drain) error {
+	if masker == nil || len(drains) == 0 {
+		return errSnapshotCorruptedRaw("snapshot without masker or drain")
+	}
+	for _, drain := range drains {
+		if drain == nil {
+			return errSnapshotCorruptedRaw("snapshot with a null drain")
+		}
+	}
+	if migrated {
+		return nil
+	}
+	hash, err := configHash(masker, drains...)
+	if err != nil {
+		return err
+	}
+	if hash != envelope.ConfigHash {
+		return errSnapshotCorruptedRaw(fmt.Sprintf("config hash %s does not match %s", envelope.ConfigHash, hash))
+	}
+	return nil
+}
+
+type configHashStruct struct {
+	Masker maskerConfigHashStruct
+	Drains []drainConfigHashStruct
+}
+
+// maskerConfigHashStruct is the canonical form of a masker, its instructions
+// are listed in the order they are applied, which is deterministic.
+type maskerConfigHashStruct struct {
+	Prefix           string
+	Suffix           string
+	MaskInstructions []logInstructionMarshalStruct
+}
+
+type drainConfigHashStruct struct {
+	MaxDepth        int
+	Sim             float32
+	MaxChildren     int
+	MaxClusters     int
+	ClusterIDOffset int64
+	ClusterIDStride int64
+	EvictionPolicy  EvictionPolicy          `json:",omitempty"`
+	Tokenizer       *tokenizerMarshalStruct `json:",omitempty"`
+}
+
+func configHash(masker *logMasker, drains ...*drain) (string, error) {
+	hashStruct := configHashStruct{Masker: maskerConfigHashStruct{
+		Prefix:           masker.prefix,
+		Suffix:           masker.suffix,
+		MaskInstructions: []logInstructionMarshalStruct{},
+	}}
+	for _, ins := range masker.instructions {
+		hashStruct.Masker.MaskInstructions = append(hashStruct.Masker.MaskInstructions, ins.marshalStruct())
+	}
+	for _, drain := range drains {
+		hashStruct.Drains = append(hashStruct.Drains, drainConfigHashStruct{
+			MaxDepth:        drain.maxDepth,
+			Sim:             drain.sim,
+			MaxChildren:     drain.maxChildren,
+			MaxClusters:     drain.maxClusters,
+			ClusterIDOffset: drain.clusterIDOffset,
+			ClusterIDStride: drain.clusterIDStride,
+			EvictionPolicy:  drain.evictionPolicy,
+			Tokenizer:       drain.tokenizer.marshalStruct(),
+		})
+	}
+	b, err := json.Marshal(&hashStruct)
+	if err != nil {
+		return "", errInternal(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// snapshotMigration upgrades the top level fields of a snapshot from its
+// version to the next one.
+type snapshotMigration func(fields map[string]json.RawMessage) (map[string]json.RawMessage, error)
+
+// snapshotMigrations holds the migration from every older format version.
+var snapshotMigrations = map[int]snapshotMigration{
+	1: migrateSnapshotV1,
+	2: migrateSnapshotV2,
+}
+
+// migrateSnapshotV1 adds the envelope to a snapshot without one.
+func migrateSnapshotV1(fields map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	fields["FormatVersion"] = json.RawMessage("2")
+	return fields, nil
+}
+
+// migrateSnapshotV2 drops the encoded prefix trees, the trees are rebuilt
+// from the clusters.
+func migrateSnapshotV2(fields map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	dropRootNode := func(raw json.RawMessage) (json.RawMessage, error) {
+		drainFields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &drainFields); err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+		delete(drainFields, "RootNode")
+		b, err := json.Marshal(drainFields)
+		if err != nil {
+			return nil, errInternal(err)
+		}
+		return b, nil
+	}
+	if raw, ok := fields["Drain"]; ok {
+		drain, err := dropRootNode(raw)
+		if err != nil {
+			return nil, err
+		}
+		fields["Drain"] = drain
+	}
+	if raw, ok := fields["Shards"]; ok {
+		shards := []json.RawMessage{}
+		if err := json.Unmarshal(raw, &shards); err != nil {
+			return nil, errSnapshotCorrupted(err)
+		}
+		for i := range shards {
+			shard, err := dropRootNode(shards[i])
+			if err != nil {
+				return nil, err
+			}
+			shards[i] = shard
+		}
+		b, err := json.Marshal(shards)
+		if err != nil {
+			return nil, errInternal(err)
+		}
+		fields["Shards"] = b
+	}
+	fields["FormatVersion"] = json.RawMessage("3")
+	return fields, nil
+}
+
+// migrateSnapshot upgrades data to the current format version. It returns the
+// upgraded snapshot and whether it was written by an older version.
+func migrateSnapshot(data []byte) ([]byte, bool, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false, errSnapshotCorrupted(err)
+	}
+	version := 1
+	if raw, ok := fields["FormatVersion"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, false, errSnapshotCorrupted(err)
+		}
+	}
+	if version > snapshot_format_version {
+		return nil, false, errSnapshotVersionRaw(fmt.Sprintf(
+			"snapshot format version %d is newer than %d, upgrade the library", version, snapshot_format_version))
+	}
+	if version == snapshot_format_version {
+		return data, false, nil
+	}
+	for version < snapshot_format_version {
+		migration, ok := snapshotMigrations[version]
+		if !ok {
+			return nil, false, errSnapshotVersionRaw(fmt.Sprintf("no migration from snapshot format version %d", version))
+		}
+		var err error
+		if fields, err = migration(fields); err != nil {
+			return nil, false, err
+		}
+		version += 1
+	}
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false, errInternal(err)
+	}
+	return migrated, true, nil
+}
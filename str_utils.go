@@ -18,3 +18,9 @@ func stringHasNumber(message string) bool {
 	}
 	return false
 }
+
+// historyTokens splits a template or a message of the template history on
+// single spaces, joined back they restore it unchanged.
+func historyTokens(s string) []string {
+	return strings.Split(s, " ")
+}
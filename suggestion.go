@@ -0,0 +1,207 @@
+package loggingdrain
+
+import "sort"
+
+type ClusterSuggestion struct {
+	Cluster *LogCluster
+	// Similarity is the share of aligned tokens equal to each other or
+	// matched by a wildcard, over the longest of the template and the message.
+	Similarity float32
+	// ParamCount is the number of wildcards in the template.
+	ParamCount int64
+	// Diff lists the tokens of the template and the message that disagree.
+	Diff []TokenDiff
+}
+
+// TokenDiff is a template token and a message token which disagree. A token
+// without a counterpart, when their lengths differ, has a position of -1 and
+// an empty token on the other side.
+type TokenDiff struct {
+	TemplatePosition int
+	TemplateToken    string
+	MessagePosition  int
+	MessageToken     string
+}
+
+// SuggestClusters returns the k clusters closest to message, most similar
+// first, even when none of them would match it. Only clusters with the token
+// count of message are considered unless WithSuggestLengthTolerance is set.
+func (miner *TemplateMiner) SuggestClusters(message string, k int, options ...suggestOption) []*ClusterSuggestion {
+	conf := newSuggestConfig(options)
+	maskedMessage := miner.masker.mask(message)
+	return miner.drain.suggest(miner.drain.tokenize(maskedMessage), k, conf.LengthTolerance)
+}
+
+func (drain *drain) suggest(tokens []string, k int, lengthTolerance int) []*ClusterSuggestion {
+	if k <= 0 {
+		return []*ClusterSuggestion{}
+	}
+	drain.mu.RLock()
+	defer drain.mu.RUnlock()
+
+	suggestions := []*ClusterSuggestion{}
+	for length := len(tokens) - lengthTolerance; length <= len(tokens)+lengthTolerance; length++ {
+		if length < 0 {
+			continue
+		}
+		for _, cluster := range drain.getClustersForSeqLen(length) {
+			if !drain.idToCluster.Contains(cluster.id) {
+				continue
+			}
+			suggestions = append(suggestions, drain.suggestion(cluster, tokens))
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Similarity != suggestions[j].Similarity {
+			return suggestions[i].Similarity > suggestions[j].Similarity
+		}
+		if suggestions[i].ParamCount != suggestions[j].ParamCount {
+			return suggestions[i].ParamCount < suggestions[j].ParamCount
+		}
+		return suggestions[i].Cluster.id < suggestions[j].Cluster.id
+	})
+	if len(suggestions) > k {
+		suggestions = suggestions[:k]
+	}
+	return suggestions
+}
+
+func (drain *drain) suggestion(cluster *LogCluster, tokens []string) *ClusterSuggestion {
+	template := cluster.logTemplateTokens
+	suggestion := &ClusterSuggestion{
+		Cluster: cluster,
+		Diff:    []TokenDiff{},
+	}
+	if len(template) == len(tokens) {
+		suggestion.Similarity, suggestion.ParamCount, _ = drain.getSeqDistance(template, tokens, true)
+		for i := range template {
+			if template[i] != tokens[i] && template[i] != default_wildcard_str {
+				suggestion.Diff = append(suggestion.Diff, TokenDiff{
+					TemplatePosition: i,
+					TemplateToken:    template[i],
+					MessagePosition:  i,
+					MessageToken:     tokens[i],
+				})
+			}
+		}
+		return suggestion
+	}
+
+	for _, token := range template {
+		if token == default_wildcard_str {
+			suggestion.ParamCount += 1
+		}
+	}
+	matched, diff := alignTokens(template, tokens)
+	longest := len(template)
+	if len(tokens) > longest {
+		longest = len(tokens)
+	}
+	suggestion.Similarity = float32(matched) / float32(longest)
+	suggestion.Diff = diff
+	return suggestion
+}
+
+// alignTokens aligns template and tokens with the minimal number of token
+// edits, a wildcard being equal to any token. It returns the number of
+// aligned tokens which agree and the tokens which disagree.
+func alignTokens(template, tokens []string) (int, []TokenDiff) {
+	same := func(i, j int) bool {
+		return template[i] == tokens[j] || template[i] == default_wildcard_str
+	}
+	// cost[i][j] is the edit distance between template[i:] and tokens[j:]
+	cost := make([][]int, len(template)+1)
+	for i := range cost {
+		cost[i] = make([]int, len(tokens)+1)
+	}
+	for i := len(template); i >= 0; i-- {
+		for j := len(tokens); j >= 0; j-- {
+			switch {
+			case i == len(template):
+				cost[i][j] = len(tokens) - j
+			case j == len(tokens):
+				cost[i][j] = len(template) - i
+			default:
+				substitute := cost[i+1][j+1]
+				if !same(i, j) {
+					substitute += 1
+				}
+				cost[i][j] = minInt(substitute, minInt(cost[i+1][j], cost[i][j+1])+1)
+			}
+		}
+	}
+
+	matched := 0
+	diff := []TokenDiff{}
+	i, j := 0, 0
+	for i < len(template) || j < len(tokens) {
+		switch {
+		case i < len(template) && j < len(tokens) && same(i, j) && cost[i][j] == cost[i+1][j+1]:
+			matched += 1
+			i, j = i+1, j+1
+		case i < len(template) && j < len(tokens) && cost[i][j] == cost[i+1][j+1]+1:
+			diff = append(diff, TokenDiff{
+				TemplatePosition: i,
+				TemplateToken:    template[i],
+				MessagePosition:  j,
+				MessageToken:     tokens[j],
+			})
+			i, j = i+1, j+1
+		case i < len(template) && cost[i][j] == cost[i+1][j]+1:
+			diff = append(diff, TokenDiff{
+				TemplatePosition: i,
+				TemplateToken:    template[i],
+				MessagePosition:  -1,
+			})
+			i += 1
+		default:
+			diff = append(diff, TokenDiff{
+				TemplatePosition: -1,
+				MessagePosition:  j,
+				MessageToken:     tokens[j],
+			})
+			j += 1
+		}
+	}
+	return matched, diff
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type suggestConfig struct {
+	LengthTolerance int
+}
+
+func newSuggestConfig(options []suggestOption) suggestConfig {
+	conf := suggestConfig{
+		LengthTolerance: 0,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	return conf
+}
+
+// WithSuggestLengthTolerance also suggests clusters whose token count differs
+// from the one of the message by at most tolerance.
+func WithSuggestLengthTolerance(tolerance int) suggestOption {
+	return suggestOptionFunc(func(conf suggestConfig) suggestConfig {
+		conf.LengthTolerance = tolerance
+		return conf
+	})
+}
+
+type suggestOption interface {
+	apply(suggestConfig) suggestConfig
+}
+
+type suggestOptionFunc func(suggestConfig) suggestConfig
+
+func (o suggestOptionFunc) apply(conf suggestConfig) suggestConfig {
+	return o(conf)
+}
@@ -0,0 +1,52 @@
+package loggingdrain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggestClusters(t *testing.T) {
+	miner, _ := NewTemplateMiner(WithDrainSim(0.6))
+	miner.AddLogMessage("connection from alice closed")
+	miner.AddLogMessage("connection from bob closed")
+	miner.AddLogMessage("connection to db opened")
+	miner.AddLogMessage("disk is full")
+	miner.AddLogMessage("connection from carol closed by peer")
+
+	t.Run("test same token count", func(t *testing.T) {
+		assert.Nil(t, miner.Match("connection from dave reset"))
+		suggestions := miner.SuggestClusters("connection from dave reset", 2)
+		assert.Len(t, suggestions, 2)
+
+		assert.Equal(t, "connection from [*] closed", suggestions[0].Cluster.Template())
+		assert.Equal(t, float32(0.75), suggestions[0].Similarity)
+		assert.Equal(t, int64(1), suggestions[0].ParamCount)
+		assert.Equal(t, []TokenDiff{
+			{TemplatePosition: 3, TemplateToken: "closed", MessagePosition: 3, MessageToken: "reset"},
+		}, suggestions[0].Diff)
+
+		assert.Equal(t, "connection to db opened", suggestions[1].Cluster.Template())
+		assert.Equal(t, float32(0.25), suggestions[1].Similarity)
+		assert.Len(t, suggestions[1].Diff, 3)
+	})
+	t.Run("test neighbouring token counts", func(t *testing.T) {
+		suggestions := miner.SuggestClusters("connection from dave closed by", 3, WithSuggestLengthTolerance(1))
+		assert.Len(t, suggestions, 3)
+		assert.Equal(t, "connection from [*] closed", suggestions[0].Cluster.Template())
+		assert.Equal(t, float32(0.8), suggestions[0].Similarity)
+		assert.Equal(t, []TokenDiff{
+			{TemplatePosition: -1, MessagePosition: 4, MessageToken: "by"},
+		}, suggestions[0].Diff)
+
+		assert.Equal(t, "connection from carol closed by peer", suggestions[1].Cluster.Template())
+		assert.Equal(t, []TokenDiff{
+			{TemplatePosition: 2, TemplateToken: "carol", MessagePosition: 2, MessageToken: "dave"},
+			{TemplatePosition: 5, TemplateToken: "peer", MessagePosition: -1},
+		}, suggestions[1].Diff)
+	})
+	t.Run("test no suggestion", func(t *testing.T) {
+		assert.Empty(t, miner.SuggestClusters("a b c d e f g h", 3))
+		assert.Empty(t, miner.SuggestClusters("disk is full", 0))
+	})
+}
@@ -0,0 +1,74 @@
+package loggingdrain
+
+import (
+	"strings"
+	"time"
+)
+
+const default_template_history_size = 10
+
+// TemplateChange is a generalization of the template of a cluster.
+type TemplateChange struct {
+	PreviousTemplate string
+	Template         string
+	// Message is the masked log message which generalized the template, or
+	// the template of the cluster merged or synchronized into the cluster.
+	Message string
+	// Wildcards are the positions of the tokens replaced by wildcards.
+	Wildcards []int
+	Time      time.Time
+}
+
+// History returns the latest changes of the template of the cluster, the
+// oldest first. The miner keeps a bounded number of them per cluster, see
+// WithTemplateHistorySize.
+func (cluster *LogCluster) History() []TemplateChange {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	history := make([]TemplateChange, len(cluster.history))
+	for i, change := range cluster.history {
+		history[i] = change
+		history[i].Wildcards = append([]int{}, change.Wildcards...)
+	}
+	return history
+}
+
+// generalizeTemplate updates the template of cluster with tokens, it records
+// the change in the history and the previous fingerprint in the lineage. It
+// returns the previous template tokens, nil when the template is unchanged.
+// The cluster lock must be held.
+func (drain *drain) generalizeTemplate(cluster *LogCluster, tokens []string, now time.Time) ([]string, error) {
+	if templateFits(cluster.logTemplateTokens, tokens) {
+		return nil, nil
+	}
+	previous := append([]string{}, cluster.logTemplateTokens...)
+	updated, err := drain.updateTemplate(tokens, cluster.logTemplateTokens)
+	if !updated {
+		return nil, err
+	}
+	wildcards := []int{}
+	for i, token := range cluster.logTemplateTokens {
+		if token != previous[i] {
+			wildcards = append(wildcards, i)
+		}
+	}
+	cluster.lineage = append(cluster.lineage, fingerprint(previous))
+	cluster.history = append(cluster.history, TemplateChange{
+		PreviousTemplate: strings.Join(previous, " "),
+		Template:         strings.Join(cluster.logTemplateTokens, " "),
+		Message:          strings.Join(tokens, " "),
+		Wildcards:        wildcards,
+		Time:             now,
+	})
+	if extra := len(cluster.history) - drain.maxHistory(); extra > 0 {
+		cluster.history = append([]TemplateChange{}, cluster.history[extra:]...)
+	}
+	return previous, err
+}
+
+func (drain *drain) maxHistory() int {
+	if drain.historySize < 1 {
+		return default_template_history_size
+	}
+	return drain.historySize
+}
@@ -0,0 +1,91 @@
+package loggingdrain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateHistory(t *testing.T) {
+	fixedClock := func() time.Time { return time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC) }
+	t.Run("test history", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithClock(fixedClock))
+		response := miner.AddLogMessage("user alice logged in from home")
+		assert.Empty(t, response.PreviousTemplate)
+		assert.Empty(t, response.Cluster.History())
+
+		response = miner.AddLogMessage("user bob logged in from home")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, response.ChangeType)
+		assert.Equal(t, "user alice logged in from home", response.PreviousTemplate)
+		assert.Equal(t, "user [*] logged in from home", response.TemplateMined)
+
+		miner.AddLogMessage("user bob logged in from home")
+		response = miner.AddLogMessage("user carol logged in from work")
+		assert.Equal(t, "user [*] logged in from home", response.PreviousTemplate)
+
+		assert.Equal(t, []TemplateChange{
+			{
+				PreviousTemplate: "user alice logged in from home",
+				Template:         "user [*] logged in from home",
+				Message:          "user bob logged in from home",
+				Wildcards:        []int{1},
+				Time:             fixedClock(),
+			},
+			{
+				PreviousTemplate: "user [*] logged in from home",
+				Template:         "user [*] logged in from [*]",
+				Message:          "user carol logged in from work",
+				Wildcards:        []int{5},
+				Time:             fixedClock(),
+			},
+		}, response.Cluster.History())
+	})
+	t.Run("test history is bounded", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithTemplateHistorySize(2))
+		miner.AddLogMessage("a b c d e")
+		var cluster *LogCluster
+		for _, log := range []string{"a x c d e", "a x y d e", "a x y z e"} {
+			cluster = miner.AddLogMessage(log).Cluster
+		}
+		history := cluster.History()
+		assert.Len(t, history, 2)
+		assert.Equal(t, "a [*] c d e", history[0].PreviousTemplate)
+		assert.Equal(t, "a [*] [*] [*] e", history[1].Template)
+		assert.Len(t, cluster.Lineage(), 3)
+	})
+	t.Run("test response of a restored cluster", func(t *testing.T) {
+		cluster := &LogCluster{}
+		err := json.Unmarshal([]byte(`{
+			"LogTemplateTokens": ["user", "alice", "logged", "in"],
+			"ID": 1,
+			"Size": 2,
+			"Lineage": ["abc"]
+		}`), cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drain := newDrain()
+		drain.restoreClusters([]*LogCluster{cluster})
+		response := drain.addLogMessage("user bob logged in")
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, response.ChangeType)
+		assert.Equal(t, fingerprint([]string{"user", "alice", "logged", "in"}), response.PreviousFingerprint)
+		assert.Equal(t, fingerprint([]string{"user", "[*]", "logged", "in"}), response.Fingerprint)
+		assert.Equal(t, "user [*] logged in", response.TemplateMined)
+		assert.Equal(t, "user alice logged in", response.PreviousTemplate)
+		assert.Equal(t, int64(3), response.ClusterSize)
+	})
+	t.Run("test history is persisted", func(t *testing.T) {
+		miner := newTestMinerJsonMiner()
+		history := miner.GetCluster(2).History()
+		assert.Len(t, history, 1)
+
+		data, _ := miner.MarshalBinary()
+		loaded := TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, history, loaded.GetCluster(2).History())
+	})
+}
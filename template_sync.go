@@ -0,0 +1,440 @@
+package loggingdrain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const default_sync_queue_size = 1024
+
+// SyncTransport broadcasts the cluster deltas between the replicas of a
+// service. Every replica receives the deltas it published itself as well.
+type SyncTransport interface {
+	Publish(ctx context.Context, payload []byte) error
+	// Subscribe returns the payloads published from now on, the channel is
+	// closed once ctx is done.
+	Subscribe(ctx context.Context) (<-chan []byte, error)
+}
+
+// clusterDelta is the state of a cluster published after it was created,
+// updated or deleted.
+type clusterDelta struct {
+	Node    string   `json:"n"`
+	ID      int64    `json:"i"`
+	Tokens  []string `json:"t"`
+	Deleted bool     `json:"d,omitempty"`
+}
+
+// TemplateSync keeps the templates of several replicas of a miner in sync.
+//
+// Every cluster created or updated on a replica is published to the others,
+// which learn it as if they had mined it, without changing the cluster
+// sizes. The templates only get more general and the ids only get lower, so
+// the replicas converge whatever the order of the deltas:
+//   - a delta with the exact template of a local cluster but another id
+//     gives both clusters the lower id,
+//   - a delta similar to a local cluster merges both templates,
+//   - any other delta creates a cluster with the remote id.
+//
+// A local cluster taking a lower remote id is renamed in place: the
+// *LogCluster stays valid, but its previous id no longer resolves with
+// GetCluster. The rename is reported to the handler set with
+// WithSyncIDChangeHandler with both ids, and to the persistence managers as
+// CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED. The ids of the locked clusters
+// never change.
+//
+// Only the changes made locally are published, the deltas applied are
+// reported to the other listeners of the miner but not published again. A
+// delta learned by a local cluster with a lower id is answered with the local
+// cluster, so that the sender adopts the id. The clusters deleted with
+// DeleteCluster are deleted on the other replicas too, the pins and the
+// names stay local to each replica.
+//
+// The replicas shall assign disjoint cluster ids, see WithClusterIDSpace, a
+// remote id already used by another local template is reported to the
+// error handler as a ClusterIDConflictError.
+type TemplateSync struct {
+	miner     *TemplateMiner
+	transport SyncTransport
+	conf      templateSyncConfig
+
+	listener *changeListenerEntry
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// mu guards closed and the sends on queue.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan clusterDelta
+}
+
+// NewTemplateSync starts synchronizing miner with the other replicas
+// subscribed to transport.
+func NewTemplateSync(miner *TemplateMiner, transport SyncTransport, options ...templateSyncOption) (*TemplateSync, error) {
+	conf, err := newTemplateSyncConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	deltas, err := transport.Subscribe(ctx)
+	if err != nil {
+		cancel()
+		return nil, errInternal(err)
+	}
+	s := &TemplateSync{
+		miner:     miner,
+		transport: transport,
+		conf:      conf,
+		cancel:    cancel,
+		queue:     make(chan clusterDelta, conf.QueueSize),
+	}
+	s.listener = miner.listeners.register(s.onChange)
+	s.wg.Add(2)
+	go s.publishLoop()
+	go s.receiveLoop(deltas)
+	return s, nil
+}
+
+// NodeID returns the id identifying the deltas published by this replica.
+func (s *TemplateSync) NodeID() string {
+	return s.conf.NodeID
+}
+
+// Close stops the synchronization, the pending deltas are published first.
+func (s *TemplateSync) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	s.miner.listeners.remove(s.listener)
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *TemplateSync) onChange(updateType ClusterUpdateType, cluster *LogCluster) {
+	if updateType == CLUSTER_UPDATE_TYPE_NONE || updateType == CLUSTER_UPDATE_TYPE_UPDATE_METADATA {
+		return
+	}
+	cluster.mu.RLock()
+	delta := clusterDelta{
+		Node:    s.conf.NodeID,
+		ID:      cluster.id,
+		Tokens:  append([]string{}, cluster.logTemplateTokens...),
+		Deleted: updateType == CLUSTER_UPDATE_TYPE_DELETE_CLUSTER,
+	}
+	cluster.mu.RUnlock()
+	s.enqueue(delta)
+}
+
+// enqueue never blocks the miner, a delta is dropped when the queue is full.
+func (s *TemplateSync) enqueue(delta clusterDelta) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- delta:
+	default:
+		s.reportError(errInternalRaw(fmt.Sprintf("sync queue full, delta of cluster %d dropped", delta.ID)))
+	}
+}
+
+func (s *TemplateSync) publishLoop() {
+	defer s.wg.Done()
+	for delta := range s.queue {
+		b, err := json.Marshal(&delta)
+		if err != nil {
+			s.reportError(errInternal(err))
+			continue
+		}
+		if err := s.transport.Publish(context.Background(), b); err != nil {
+			s.reportError(errInternal(err))
+		}
+	}
+}
+
+func (s *TemplateSync) receiveLoop(payloads <-chan []byte) {
+	defer s.wg.Done()
+	for payload := range payloads {
+		delta := clusterDelta{}
+		if err := json.Unmarshal(payload, &delta); err != nil {
+			s.reportError(errInternal(err))
+			continue
+		}
+		if delta.Node == s.conf.NodeID {
+			continue
+		}
+		s.apply(delta)
+	}
+}
+
+func (s *TemplateSync) apply(delta clusterDelta) {
+	if delta.Deleted {
+		// the cluster may be unknown or already deleted locally
+		if cluster, err := s.miner.drain.deleteCluster(delta.ID); err == nil {
+			s.miner.listeners.notifyExcept(s.listener, CLUSTER_UPDATE_TYPE_DELETE_CLUSTER, cluster)
+		}
+		return
+	}
+	cluster, updateType, oldID, err := s.miner.drain.applyRemoteCluster(delta.ID, delta.Tokens)
+	if err != nil {
+		s.reportError(err)
+	}
+	if cluster == nil {
+		return
+	}
+	if updateType == CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED && s.conf.OnIDChange != nil {
+		s.conf.OnIDChange(oldID, delta.ID)
+	}
+	if updateType != CLUSTER_UPDATE_TYPE_NONE {
+		s.miner.listeners.notifyExcept(s.listener, updateType, cluster)
+	}
+	cluster.mu.RLock()
+	localID := cluster.id
+	cluster.mu.RUnlock()
+	if localID < delta.ID {
+		// the local id wins, let the sender adopt it
+		s.onChange(CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER, cluster)
+	}
+}
+
+func (s *TemplateSync) reportError(err error) {
+	if s.conf.OnError != nil {
+		s.conf.OnError(err)
+	}
+}
+
+// applyRemoteCluster learns the cluster id with template tokens from another
+// replica, it returns the local cluster, how it changed and its previous id
+// when it took id.
+func (drain *drain) applyRemoteCluster(id int64, tokens []string) (*LogCluster, ClusterUpdateType, int64, error) {
+	if id < 1 {
+		return nil, CLUSTER_UPDATE_TYPE_NONE, 0, errInternalRaw(fmt.Sprintf("invalid remote cluster id %d", id))
+	}
+	now := drain.now()
+	drain.mu.Lock()
+	cluster, updateType, oldID, err := drain.applyRemoteClusterLocked(id, tokens, now)
+	evicted := drain.takeEvicted()
+	drain.mu.Unlock()
+	drain.notifyEvicted(evicted)
+	return cluster, updateType, oldID, err
+}
+
+func (drain *drain) applyRemoteClusterLocked(id int64, tokens []string, now time.Time) (*LogCluster, ClusterUpdateType, int64, error) {
+	updateType := CLUSTER_UPDATE_TYPE_NONE
+	cluster := drain.exactCluster(tokens)
+	if cluster == nil {
+		cluster = drain.treeSearch(drain.rootNode, tokens, drain.sim, false)
+		if cluster == nil {
+			if other, ok := drain.idToCluster.Peek(id); ok {
+				return nil, CLUSTER_UPDATE_TYPE_NONE, 0, errClusterIDConflictRaw(
+					fmt.Sprintf("remote cluster %d %q conflicts with %q", id, tokens, other.getTemplate()))
+			}
+			drain.reserveClusterID(id)
+			cluster = newLogCluster(id, append([]string{}, tokens...))
+			cluster.firstSeen = now
+			cluster.lastSeen = now
+			drain.addSeqToPrefixTree(drain.rootNode, cluster)
+			drain.cacheCluster(id, cluster)
+			return cluster, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, 0, nil
+		}
+		cluster.mu.Lock()
+		previous, err := drain.generalizeTemplate(cluster, tokens, now)
+		cluster.mu.Unlock()
+		if err != nil {
+			return nil, CLUSTER_UPDATE_TYPE_NONE, 0, err
+		}
+		if previous != nil {
+			updateType = CLUSTER_UPDATE_TYPE_UPDATE_CLUSTER
+		}
+	}
+	// the ids of the locked clusters are fixed
+	if id < cluster.id && !cluster.locked {
+		if other, ok := drain.idToCluster.Peek(id); ok && other != cluster {
+			return cluster, updateType, 0, errClusterIDConflictRaw(
+				fmt.Sprintf("remote cluster %d %q conflicts with %q", id, tokens, other.getTemplate()))
+		}
+		oldID := cluster.id
+		drain.idToCluster.Remove(oldID)
+		cluster.mu.Lock()
+		cluster.id = id
+		cluster.mu.Unlock()
+		drain.reserveClusterID(id)
+		drain.cacheCluster(id, cluster)
+		return cluster, CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED, oldID, nil
+	}
+	return cluster, updateType, 0, nil
+}
+
+// exactCluster returns the live cluster with template tokens.
+func (drain *drain) exactCluster(tokens []string) *LogCluster {
+	for _, cluster := range drain.getClustersForSeqLen(len(tokens)) {
+		if !drain.idToCluster.Contains(cluster.id) {
+			continue
+		}
+		if equalTokens(cluster.logTemplateTokens, tokens) {
+			return cluster
+		}
+	}
+	return nil
+}
+
+// reserveClusterID makes sure the drain never assigns id itself, in case id
+// belongs to its own id space.
+func (drain *drain) reserveClusterID(id int64) {
+	n := id - 1 - drain.clusterIDOffset
+	if n < 0 || n%drain.clusterIDStride != 0 {
+		return
+	}
+	if counter := n/drain.clusterIDStride + 1; counter > drain.clusterCounter {
+		drain.clusterCounter = counter
+	}
+}
+
+func equalTokens(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SyncTransport returns a transport publishing the deltas on the service
+// key channel. An InternalError is returned when the redis client of p is not
+// a RedisPubSubClient.
+func (p *RedisPersistence) SyncTransport() (SyncTransport, error) {
+	rdb, ok := p.rdb.(RedisPubSubClient)
+	if !ok {
+		return nil, errInternalRaw("the redis client cannot publish")
+	}
+	return &redisSyncTransport{persistence: p, rdb: rdb}, nil
+}
+
+type redisSyncTransport struct {
+	persistence *RedisPersistence
+	rdb         RedisPubSubClient
+}
+
+func (t *redisSyncTransport) Publish(ctx context.Context, payload []byte) error {
+	return t.rdb.Publish(ctx, t.persistence.serviceKey, payload).Err()
+}
+
+func (t *redisSyncTransport) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	pubsub := t.persistence.Subscribe(ctx)
+	// wait for the subscription, so that no delta published afterwards is lost
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	messages := pubsub.Channel()
+	payloads := make(chan []byte)
+	go func() {
+		defer close(payloads)
+		defer pubsub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case payloads <- []byte(message.Payload):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return payloads, nil
+}
+
+type templateSyncConfig struct {
+	NodeID     string
+	QueueSize  int
+	OnError    func(error)
+	OnIDChange func(oldID, newID int64)
+}
+
+func newTemplateSyncConfig(options []templateSyncOption) (templateSyncConfig, error) {
+	conf := templateSyncConfig{
+		QueueSize: default_sync_queue_size,
+	}
+	for _, o := range options {
+		conf = o.apply(conf)
+	}
+	if conf.NodeID == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return conf, errInternal(err)
+		}
+		conf.NodeID = hex.EncodeToString(b)
+	}
+	if conf.QueueSize < 1 {
+		conf.QueueSize = default_sync_queue_size
+	}
+	return conf, nil
+}
+
+// WithSyncNodeID sets the id of the replica, a random id by default.
+func WithSyncNodeID(nodeID string) templateSyncOption {
+	return templateSyncOptionFunc(func(conf templateSyncConfig) templateSyncConfig {
+		conf.NodeID = nodeID
+		return conf
+	})
+}
+
+// WithSyncQueueSize sets how many deltas may wait to be published, 1024 by
+// default.
+func WithSyncQueueSize(size int) templateSyncOption {
+	return templateSyncOptionFunc(func(conf templateSyncConfig) templateSyncConfig {
+		conf.QueueSize = size
+		return conf
+	})
+}
+
+// WithSyncErrorHandler sets the function called with the errors of the
+// background synchronization.
+func WithSyncErrorHandler(onError func(error)) templateSyncOption {
+	return templateSyncOptionFunc(func(conf templateSyncConfig) templateSyncConfig {
+		conf.OnError = onError
+		return conf
+	})
+}
+
+// WithSyncIDChangeHandler sets the function called when a local cluster
+// takes the id of a remote replica, the ids held by the caller should be
+// replaced then.
+func WithSyncIDChangeHandler(onIDChange func(oldID, newID int64)) templateSyncOption {
+	return templateSyncOptionFunc(func(conf templateSyncConfig) templateSyncConfig {
+		conf.OnIDChange = onIDChange
+		return conf
+	})
+}
+
+type templateSyncOption interface {
+	apply(templateSyncConfig) templateSyncConfig
+}
+
+type templateSyncOptionFunc func(templateSyncConfig) templateSyncConfig
+
+func (o templateSyncOptionFunc) apply(conf templateSyncConfig) templateSyncConfig {
+	return o(conf)
+}
@@ -0,0 +1,243 @@
+package loggingdrain
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySyncHub is an in-process stand-in for a Redis channel.
+type memorySyncHub struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]context.Context
+	published   int
+}
+
+func newMemorySyncHub() *memorySyncHub {
+	return &memorySyncHub{
+		subscribers: map[chan []byte]context.Context{},
+	}
+}
+
+func (h *memorySyncHub) Publish(ctx context.Context, payload []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.published += 1
+	for ch, subCtx := range h.subscribers {
+		select {
+		case ch <- payload:
+		case <-subCtx.Done():
+		}
+	}
+	return nil
+}
+
+func (h *memorySyncHub) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	ch := make(chan []byte, 1024)
+	h.mu.Lock()
+	h.subscribers[ch] = ctx
+	h.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		close(ch)
+		h.mu.Unlock()
+	}()
+	return ch, nil
+}
+
+func (h *memorySyncHub) publishedCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.published
+}
+
+func clusterTemplates(miner *TemplateMiner) []string {
+	templates := []string{}
+	for _, cluster := range miner.Clusters(CLUSTER_SORT_BY_ID) {
+		templates = append(templates, fmt.Sprintf("%d %s", cluster.ID(), cluster.Template()))
+	}
+	return templates
+}
+
+// newSyncedMiners returns count synchronized miners and a function returning
+// the synchronization errors.
+func newSyncedMiners(t *testing.T, hub *memorySyncHub, count int) ([]*TemplateMiner, func() []error) {
+	errs := []error{}
+	mu := sync.Mutex{}
+	miners := []*TemplateMiner{}
+	for i := 0; i < count; i++ {
+		miner, err := NewTemplateMiner(
+			WithMaskInsturction(`\b\d+\b`, "NUM"),
+			WithClusterIDSpace(int64(i), int64(count)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewTemplateSync(miner, hub,
+			WithSyncNodeID(fmt.Sprintf("node%d", i)),
+			WithSyncErrorHandler(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		miners = append(miners, miner)
+	}
+	return miners, func() []error {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]error{}, errs...)
+	}
+}
+
+func TestTemplateSync(t *testing.T) {
+	t.Run("test replicas converge", func(t *testing.T) {
+		miners, errs := newSyncedMiners(t, newMemorySyncHub(), 3)
+		wg := sync.WaitGroup{}
+		for i, miner := range miners {
+			wg.Add(1)
+			go func(i int, miner *TemplateMiner) {
+				defer wg.Done()
+				for j := i; j < 600; j += len(miners) {
+					miner.AddLogMessage(testData[j])
+				}
+			}(i, miner)
+		}
+		wg.Wait()
+		assert.Eventually(t, func() bool {
+			expected := clusterTemplates(miners[0])
+			for _, miner := range miners[1:] {
+				if !assert.ObjectsAreEqual(expected, clusterTemplates(miner)) {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Empty(t, errs())
+	})
+	t.Run("test same template keeps the lowest id", func(t *testing.T) {
+		miners, _ := newSyncedMiners(t, newMemorySyncHub(), 2)
+		miners[1].AddLogMessage("connection from alice closed")
+		miners[0].AddLogMessage("connection from alice closed")
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"1 connection from alice closed"}, clusterTemplates(miners[0])) &&
+				assert.ObjectsAreEqual([]string{"1 connection from alice closed"}, clusterTemplates(miners[1]))
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, int64(1), miners[0].Clusters(CLUSTER_SORT_BY_ID)[0].Size())
+		assert.Equal(t, int64(1), miners[1].Clusters(CLUSTER_SORT_BY_ID)[0].Size())
+	})
+	t.Run("test similar templates are merged", func(t *testing.T) {
+		miners, _ := newSyncedMiners(t, newMemorySyncHub(), 2)
+		miners[0].AddLogMessage("user alice logged in")
+		assert.Eventually(t, func() bool {
+			return len(miners[1].Clusters(CLUSTER_SORT_BY_ID)) == 1
+		}, time.Second, 5*time.Millisecond)
+		miners[1].AddLogMessage("user bob logged in")
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"1 user [*] logged in"}, clusterTemplates(miners[0]))
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{"1 user [*] logged in"}, clusterTemplates(miners[1]))
+	})
+	t.Run("test remote deltas are not published again", func(t *testing.T) {
+		hub := newMemorySyncHub()
+		miners, errs := newSyncedMiners(t, hub, 3)
+		cluster := miners[0].AddLogMessage("user alice logged in").Cluster
+		assert.Eventually(t, func() bool {
+			return miners[1].GetCluster(cluster.ID()) != nil && miners[2].GetCluster(cluster.ID()) != nil
+		}, time.Second, 5*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, 1, hub.publishedCount())
+		assert.Empty(t, errs())
+	})
+	t.Run("test deletions are synced", func(t *testing.T) {
+		miners, errs := newSyncedMiners(t, newMemorySyncHub(), 2)
+		cluster := miners[0].AddLogMessage("user alice logged in").Cluster
+		assert.Eventually(t, func() bool {
+			return miners[1].GetCluster(cluster.ID()) != nil
+		}, time.Second, 5*time.Millisecond)
+
+		assert.Nil(t, miners[0].DeleteCluster(cluster.ID()))
+		assert.Eventually(t, func() bool {
+			return miners[1].GetCluster(cluster.ID()) == nil
+		}, time.Second, 5*time.Millisecond)
+		assert.Empty(t, clusterTemplates(miners[0]))
+		assert.Empty(t, errs())
+	})
+	t.Run("test id conflict", func(t *testing.T) {
+		d := newDrain()
+		d.addLogMessage("a b c")
+		_, _, _, err := d.applyRemoteCluster(1, []string{"x", "y"})
+		assert.True(t, errorIs(err, clusterIDConflictError))
+
+		cluster, updateType, _, err := d.applyRemoteCluster(3, []string{"x", "y"})
+		assert.Nil(t, err)
+		assert.Equal(t, CLUSTER_UPDATE_TYPE_NEW_CLUSTER, updateType)
+		assert.Equal(t, int64(3), cluster.ID())
+		assert.Equal(t, int64(4), d.nextClusterID())
+	})
+	t.Run("test id change is reported", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithClusterIDSpace(1, 2))
+		cluster := miner.AddLogMessage("connection from alice closed").Cluster
+		assert.Equal(t, int64(2), cluster.ID())
+
+		mu := sync.Mutex{}
+		changes := [][2]int64{}
+		updateTypes := []ClusterUpdateType{}
+		removeListener := miner.listeners.add(func(updateType ClusterUpdateType, _ *LogCluster) {
+			mu.Lock()
+			defer mu.Unlock()
+			updateTypes = append(updateTypes, updateType)
+		})
+		defer removeListener()
+		hub := newMemorySyncHub()
+		s, err := NewTemplateSync(miner, hub, WithSyncNodeID("local"),
+			WithSyncIDChangeHandler(func(oldID, newID int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				changes = append(changes, [2]int64{oldID, newID})
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		assert.Nil(t, hub.Publish(context.Background(),
+			[]byte(`{"n":"remote","i":1,"t":["connection","from","alice","closed"]}`)))
+		// the handler runs before the listeners
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(updateTypes) > 0
+		}, time.Second, 5*time.Millisecond)
+		assert.Same(t, cluster, miner.GetCluster(1))
+		assert.Nil(t, miner.GetCluster(2))
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, [][2]int64{{2, 1}}, changes)
+		assert.Equal(t, []ClusterUpdateType{CLUSTER_UPDATE_TYPE_CLUSTER_ID_CHANGED}, updateTypes)
+	})
+	t.Run("test redis transport publishes on the service key", func(t *testing.T) {
+		rdb := newFakeRedisClient()
+		transport, err := newTestRedisPersistence(rdb).SyncTransport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, transport.Publish(context.Background(), []byte(`{"n":"a","i":1,"t":["x"]}`)))
+		assert.Equal(t, []string{`{"n":"a","i":1,"t":["x"]}`}, rdb.published["test"])
+
+		// a client implementing RedisClient only cannot publish
+		_, err = newTestRedisPersistence(struct{ RedisClient }{rdb}).SyncTransport()
+		assert.True(t, errorIs(err, internalError))
+	})
+}
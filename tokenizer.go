@@ -0,0 +1,232 @@
+package loggingdrain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Tokenizer splits a masked log message into the tokens compared by the
+// drain. Joined with single spaces, the tokens must tokenize the same again,
+// templates are tokenized like messages.
+type Tokenizer interface {
+	Tokenize(message string) []string
+}
+
+// SeparatorTokenizer is a Tokenizer describing the text it drops between two
+// tokens, so that ExtractParameters does not include it in the values.
+// Whitespace only is assumed for the other tokenizers.
+type SeparatorTokenizer interface {
+	Tokenizer
+	// SeparatorPattern returns a regexp matching the text between two
+	// tokens.
+	SeparatorPattern() string
+}
+
+var (
+	tokenizersMu sync.RWMutex
+	tokenizers   = map[string]Tokenizer{}
+)
+
+// RegisterTokenizer makes tokenizer available to WithRegisteredTokenizer
+// under name, replacing the tokenizer registered before with name. The
+// snapshots record the name only, so the process restoring a snapshot must
+// register the same tokenizers first.
+func RegisterTokenizer(name string, tokenizer Tokenizer) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	tokenizers[name] = tokenizer
+}
+
+func registeredTokenizer(name string) (Tokenizer, bool) {
+	tokenizersMu.RLock()
+	defer tokenizersMu.RUnlock()
+	tokenizer, ok := tokenizers[name]
+	return tokenizer, ok
+}
+
+// tokenizer is the tokenizer of a drain, the zero value splits on whitespace
+// like getStringTokens.
+type tokenizer struct {
+	// name is the registered name of custom, which replaces the built-in
+	// tokenizer.
+	name   string
+	custom Tokenizer
+
+	extraDelimiters string
+	quotes          string
+	keyValue        bool
+}
+
+type tokenizerMarshalStruct struct {
+	Name            string `json:",omitempty"`
+	ExtraDelimiters string `json:",omitempty"`
+	Quotes          string `json:",omitempty"`
+	KeyValue        bool   `json:",omitempty"`
+}
+
+func (t tokenizer) marshalStruct() *tokenizerMarshalStruct {
+	if t.isDefault() {
+		return nil
+	}
+	return &tokenizerMarshalStruct{
+		Name:            t.name,
+		ExtraDelimiters: t.extraDelimiters,
+		Quotes:          t.quotes,
+		KeyValue:        t.keyValue,
+	}
+}
+
+// tokenizerFromMarshalStruct resolves the registered tokenizer of s, an
+// unregistered name is a TokenizerError as when the miner is built.
+func tokenizerFromMarshalStruct(s *tokenizerMarshalStruct) (tokenizer, error) {
+	if s == nil {
+		return tokenizer{}, nil
+	}
+	return tokenizer{
+		name:            s.Name,
+		extraDelimiters: s.ExtraDelimiters,
+		quotes:          s.Quotes,
+		keyValue:        s.KeyValue,
+	}.resolve()
+}
+
+// resolve looks up the registered tokenizer of t, an unregistered name is a
+// TokenizerError.
+func (t tokenizer) resolve() (tokenizer, error) {
+	if t.name == "" || t.custom != nil {
+		return t, nil
+	}
+	custom, ok := registeredTokenizer(t.name)
+	if !ok {
+		return tokenizer{}, errTokenizerRaw(fmt.Sprintf("unregistered tokenizer %q", t.name))
+	}
+	t.custom = custom
+	return t, nil
+}
+
+func (t tokenizer) isDefault() bool {
+	return t.name == "" && t.extraDelimiters == "" && t.quotes == "" && !t.keyValue
+}
+
+func (t tokenizer) tokenize(message string) []string {
+	if t.custom != nil {
+		return t.custom.Tokenize(message)
+	}
+	if t.isDefault() {
+		return getStringTokens(message)
+	}
+	tokens := []string{}
+	var b strings.Builder
+	flush := func() {
+		if b.Len() > 0 {
+			tokens = append(tokens, b.String())
+			b.Reset()
+		}
+	}
+	var quote rune
+	escaped := false
+	for _, r := range message {
+		switch {
+		case quote != 0:
+			b.WriteRune(r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == quote {
+				quote = 0
+			}
+		case unicode.IsSpace(r) || strings.ContainsRune(t.extraDelimiters, r):
+			flush()
+		case strings.ContainsRune(t.quotes, r):
+			quote = r
+			b.WriteRune(r)
+		case r == '=' && t.keyValue && isKey(b.String()):
+			b.WriteRune(r)
+			flush()
+		default:
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// isKey reports whether s is the key of a key=value token: letters, digits
+// and "_.-" only, so that the values holding a "=" such as urls are kept.
+func isKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_.-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// separators returns the patterns matching the text between two tokens of a
+// raw message, and between the tokens after a key of the key=value splitting.
+func (t tokenizer) separators() (string, string) {
+	if custom, ok := t.custom.(SeparatorTokenizer); ok {
+		pattern := `(?:` + custom.SeparatorPattern() + `)`
+		return pattern, pattern + `?`
+	}
+	if t.custom != nil {
+		return `\s*`, `\s*`
+	}
+	if t.extraDelimiters == "" {
+		return `\s+`, `\s*`
+	}
+	class := `[\s` + regexp.QuoteMeta(t.extraDelimiters) + `]`
+	return class + `+`, class + `*`
+}
+
+// splitsAfter reports whether the token is a key of the key=value splitting.
+func (t tokenizer) splitsAfter(token string) bool {
+	return t.custom == nil && t.keyValue && strings.HasSuffix(token, "=")
+}
+
+// WithExtraDelimiters splits the tokens on the characters of delimiters as
+// well as on whitespace, the delimiters are dropped. Delimiters found in the
+// mask placeholders split them too.
+func WithExtraDelimiters(delimiters string) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain.Tokenizer.extraDelimiters = delimiters
+		return conf
+	})
+}
+
+// WithQuotedStrings keeps the strings enclosed in one of the quote characters
+// of quotes in a single token, with their whitespace and delimiters. A quote
+// is escaped by a backslash.
+func WithQuotedStrings(quotes string) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain.Tokenizer.quotes = quotes
+		return conf
+	})
+}
+
+// WithKeyValueSplitting splits the key=value tokens after the "=" of every
+// key, so that "key=" is a constant token and the value may become a
+// wildcard. The keys are made of letters, digits and "_.-".
+func WithKeyValueSplitting() minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain.Tokenizer.keyValue = true
+		return conf
+	})
+}
+
+// WithRegisteredTokenizer tokenizes the messages with the tokenizer
+// registered with name, instead of the built-in tokenizer. An unregistered
+// name is a TokenizerError, also when a snapshot naming it is loaded.
+func WithRegisteredTokenizer(name string) minerOption {
+	return minerOptionFunc(func(conf minerConfig) minerConfig {
+		conf.Drain.Tokenizer.name = name
+		return conf
+	})
+}
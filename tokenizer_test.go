@@ -0,0 +1,143 @@
+package loggingdrain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenizer(t *testing.T) {
+	testData := []struct {
+		tokenizer tokenizer
+		message   string
+		tokens    []string
+	}{
+		{
+			tokenizer: tokenizer{},
+			message:   " user=alice,status=200  done ",
+			tokens:    []string{"user=alice,status=200", "done"},
+		},
+		{
+			tokenizer: tokenizer{extraDelimiters: ",;"},
+			message:   "user=alice,status=200;; done",
+			tokens:    []string{"user=alice", "status=200", "done"},
+		},
+		{
+			tokenizer: tokenizer{keyValue: true},
+			message:   "user=alice a==b =x url=/a?b=c k=v=w",
+			tokens:    []string{"user=", "alice", "a=", "=b", "=x", "url=", "/a?b=c", "k=", "v=", "w"},
+		},
+		{
+			tokenizer: tokenizer{quotes: `"'`},
+			message:   `say "hello,  world" and 'it\'s "ok"' "open`,
+			tokens:    []string{"say", `"hello,  world"`, "and", `'it\'s "ok"'`, `"open`},
+		},
+		{
+			tokenizer: tokenizer{extraDelimiters: ",", quotes: `"`, keyValue: true},
+			message:   `user=alice,msg="a, b=c" status=200`,
+			tokens:    []string{"user=", "alice", "msg=", `"a, b=c"`, "status=", "200"},
+		},
+	}
+	for _, data := range testData {
+		t.Run(fmt.Sprintf("tokenize %s", data.message), func(t *testing.T) {
+			tokens := data.tokenizer.tokenize(data.message)
+			assert.Equal(t, data.tokens, tokens)
+			// templates tokenize like the messages
+			assert.Equal(t, tokens, data.tokenizer.tokenize(strings.Join(tokens, " ")))
+		})
+	}
+
+	t.Run("test key value generalization", func(t *testing.T) {
+		miner, err := NewTemplateMiner(WithExtraDelimiters(","), WithKeyValueSplitting())
+		if err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("user=alice,status=200")
+		response := miner.AddLogMessage("user=bob,status=500")
+		assert.Equal(t, "user= [*] status= [*]", response.TemplateMined)
+
+		params, err := miner.ExtractClusterParameters(response.Cluster, "user=carol,status=404")
+		assert.Nil(t, err)
+		assert.Equal(t, []ExtractedParameter{
+			{Value: "carol", Position: 1, MaskName: WILDCARD_MASK_NAME},
+			{Value: "404", Position: 3, MaskName: WILDCARD_MASK_NAME},
+		}, params)
+		assert.Same(t, response.Cluster, miner.Match("user=dave, status=302"))
+	})
+	t.Run("test tokenizer is persisted", func(t *testing.T) {
+		miner, _ := NewTemplateMiner(WithExtraDelimiters(","), WithQuotedStrings(`"`), WithKeyValueSplitting())
+		miner.AddLogMessage(`user=alice,msg="a b"`)
+		miner.AddLogMessage(`user=bob,msg="c d"`)
+
+		b, _ := json.Marshal(miner)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.drain.tokenizer, loaded.drain.tokenizer)
+		assert.NotNil(t, loaded.Match(`user=carol,msg="e f"`))
+
+		data, _ := miner.MarshalBinary()
+		loaded = TemplateMiner{}
+		if err := loaded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, miner.drain.tokenizer, loaded.drain.tokenizer)
+		assert.NotNil(t, loaded.Match(`user=carol,msg="e f"`))
+	})
+	t.Run("test registered tokenizer", func(t *testing.T) {
+		RegisterTokenizer("test-pipe", pipeTokenizer{})
+		_, err := NewTemplateMiner(WithRegisteredTokenizer("test-missing"))
+		assert.True(t, errorIs(err, tokenizerError))
+
+		miner, err := NewTemplateMiner(WithRegisteredTokenizer("test-pipe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("get|/a|200")
+		response := miner.AddLogMessage("get|/b|200")
+		assert.Equal(t, "get [*] 200", response.TemplateMined)
+		params, err := miner.ExtractClusterParameters(response.Cluster, "get|/c|200")
+		assert.Nil(t, err)
+		assert.Equal(t, "/c", params[0].Value)
+
+		b, _ := json.Marshal(miner)
+		assert.Contains(t, string(b), `"Name":"test-pipe"`)
+		loaded := TemplateMiner{}
+		if err := json.Unmarshal(b, &loaded); err != nil {
+			t.Fatal(err)
+		}
+		assert.Same(t, loaded.GetCluster(response.Cluster.ID()), loaded.Match("get|/d|200"))
+	})
+	t.Run("test unregistered tokenizer on load", func(t *testing.T) {
+		RegisterTokenizer("test-pipe", pipeTokenizer{})
+		miner, err := NewTemplateMiner(WithRegisteredTokenizer("test-pipe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		miner.AddLogMessage("get|/a|200")
+
+		// same length names keep the binary snapshot well formed
+		b, _ := json.Marshal(miner)
+		_, err = decodeSnapshot(bytes.ReplaceAll(b, []byte("test-pipe"), []byte("test-gone")))
+		assert.True(t, errorIs(err, tokenizerError))
+
+		data, _ := miner.MarshalBinary()
+		_, err = decodeSnapshot(bytes.ReplaceAll(data, []byte("test-pipe"), []byte("test-gone")))
+		assert.True(t, errorIs(err, tokenizerError))
+	})
+}
+
+type pipeTokenizer struct{}
+
+func (pipeTokenizer) Tokenize(message string) []string {
+	return strings.FieldsFunc(message, func(r rune) bool { return r == '|' || r == ' ' })
+}
+
+func (pipeTokenizer) SeparatorPattern() string {
+	return `[|\s]+`
+}